@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+var ARCHIVE_DIR = dataPath("archive")
+
+// Expired rooms are written to ARCHIVE_DIR, one file per room, and kept for
+// ARCHIVE_RETENTION. The next handshake to the same roomId brings back the
+// room state and team saves. Reserved rooms are saved there too, so they
+// survive restarts, and their archives never expire.
+func archivePath(roomId string) string {
+	return filepath.Join(ARCHIVE_DIR, url.PathEscape(roomId)+".json")
+}
+
+func (r *Room) archiveJson() string {
+	r.mu.Lock()
+	value, _ := sjson.Set(`{}`, "roomId", r.id)
+	value, _ = sjson.Set(value, "createdAt", r.createdAt.UnixMilli())
+	value, _ = sjson.Set(value, "version", r.version)
+	value, _ = sjson.SetRaw(value, "state", r.state)
+	r.mu.Unlock()
+
+	value, _ = sjson.SetRaw(value, "teams", `{}`)
+	r.teams.Range(func(_, teamValue interface{}) bool {
+		team := teamValue.(*Team)
+		team.mu.Lock()
+		if team.usageLocked() > 0 {
+			path := "teams." + gjson.Escape(team.id)
+			value, _ = sjson.SetRaw(value, path+".state", team.state)
+			value, _ = sjson.Set(value, path+".queue", team.queue)
+			value, _ = sjson.Set(value, path+".queueKeys", team.queueKeys)
+		}
+		team.mu.Unlock()
+		return true
+	})
+
+	return value
+}
+
+func (s *Server) archiveRoom(room *Room) {
+	if ARCHIVE_RETENTION <= 0 {
+		return
+	}
+	if s.writeArchive(room) {
+		log.Println("Archived room", room.id)
+	}
+}
+
+// Writes the room's archive unless it is unchanged since the last write,
+// returns false on errors
+func (s *Server) writeArchive(room *Room) bool {
+	value := room.archiveJson()
+	room.mu.Lock()
+	unchanged := value == room.archived
+	room.mu.Unlock()
+	if unchanged {
+		return true
+	}
+
+	if err := os.MkdirAll(ARCHIVE_DIR, 0755); err != nil {
+		log.Println("Error creating archive directory:", err)
+		return false
+	}
+	archived, _ := sjson.Set(value, "archivedAt", time.Now().UnixMilli())
+	if err := writeFileAtomic(archivePath(room.id), []byte(archived)); err != nil {
+		log.Println("Error archiving room", room.id+":", err)
+		return false
+	}
+
+	room.mu.Lock()
+	room.archived = value
+	room.mu.Unlock()
+	return true
+}
+
+// Rebuilds a room from its archive, or returns nil if there is none that is
+// still within the retention period
+func (s *Server) loadArchivedRoom(roomId string) *Room {
+	reserved := s.reserved.get(roomId) != nil
+	if ARCHIVE_RETENTION <= 0 && !reserved {
+		return nil
+	}
+
+	value, err := os.ReadFile(archivePath(roomId))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Error reading archive of room", roomId+":", err)
+		}
+		return nil
+	}
+	if !gjson.ValidBytes(value) {
+		log.Println("Archive of room", roomId, "is not valid JSON, ignoring it")
+		return nil
+	}
+
+	archived := gjson.ParseBytes(value)
+	if !reserved && time.Since(time.UnixMilli(archived.Get("archivedAt").Int())) > ARCHIVE_RETENTION {
+		return nil
+	}
+
+	room := &Room{
+		id:        roomId,
+		clients:   sync.Map{},
+		teams:     sync.Map{},
+		state:     archived.Get("state").Raw,
+		version:   archived.Get("version").Uint(),
+		createdAt: time.UnixMilli(archived.Get("createdAt").Int()),
+		server:    s,
+		lifecycle: ROOM_ACTIVE,
+	}
+	if !gjson.Parse(room.state).IsObject() {
+		room.state = "{}"
+	}
+
+	archived.Get("teams").ForEach(func(teamId, value gjson.Result) bool {
+		team := room.findOrCreateTeam(teamId.String())
+		if state := value.Get("state"); state.IsObject() {
+			team.state = state.Raw
+		}
+		keys := value.Get("queueKeys").Array()
+		for i, packet := range value.Get("queue").Array() {
+			team.queue = append(team.queue, packet.String())
+			key := ""
+			if i < len(keys) {
+				key = keys[i].String()
+			}
+			team.queueKeys = append(team.queueKeys, key)
+		}
+		return true
+	})
+
+	return room
+}
+
+// Bytes held by a room that was built outside of the usual write paths
+func (r *Room) initialUsage() int {
+	r.mu.Lock()
+	usage := len(r.state)
+	r.mu.Unlock()
+
+	r.teams.Range(func(_, value interface{}) bool {
+		usage += value.(*Team).usage()
+		return true
+	})
+	return usage
+}
+
+// Deletes archives older than ARCHIVE_RETENTION, except those of reserved rooms
+func (s *Server) pruneArchive(errChan chan error) {
+	if ARCHIVE_RETENTION <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	defer func() {
+		if r := recover(); r != nil {
+			errChan <- fmt.Errorf("panic in pruneArchive: %v", r)
+		}
+	}()
+
+	for ; true; <-ticker.C {
+		entries, err := os.ReadDir(ARCHIVE_DIR)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Println("Error reading archive directory:", err)
+			}
+			continue
+		}
+
+		for _, entry := range entries {
+			if !strings.HasSuffix(entry.Name(), ".json") {
+				continue
+			}
+			if roomId, err := url.PathUnescape(strings.TrimSuffix(entry.Name(), ".json")); err == nil && s.reserved.get(roomId) != nil {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil || time.Since(info.ModTime()) <= ARCHIVE_RETENTION {
+				continue
+			}
+			if err := os.Remove(filepath.Join(ARCHIVE_DIR, entry.Name())); err != nil {
+				log.Println("Error removing expired archive:", err)
+			}
+		}
+	}
+}
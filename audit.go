@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+var AUDIT_FILE = dataPath("audit.log")
+
+const (
+	SOURCE_STDIN  = "stdin"
+	SOURCE_REMOTE = "remote"
+)
+
+// Who issued an admin command and where it came from
+type Operator struct {
+	name    string
+	claimed string // Name a remote caller gave for itself, unverified
+	source  string
+}
+
+func (o Operator) String() string {
+	if o.claimed == "" || o.claimed == o.name {
+		return o.name
+	}
+	return fmt.Sprintf("%s (claims %s)", o.name, o.claimed)
+}
+
+// A single administrative action, as written to the audit log
+type AuditEntry struct {
+	action    string
+	args      []string
+	operator  Operator
+	clientIds []uint64
+	roomIds   []string
+}
+
+// Append-only, newline delimited JSON record of admin actions
+type AuditLog struct {
+	path string
+	mu   sync.Mutex // Serializes appends so entries never interleave
+}
+
+func NewAuditLog(path string) *AuditLog {
+	return &AuditLog{path: path}
+}
+
+func stdinOperator() Operator {
+	name := "console"
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		name = u.Username
+	}
+
+	return Operator{name: name, source: SOURCE_STDIN}
+}
+
+func (a *AuditLog) record(entry AuditEntry) {
+	if entry.args == nil {
+		entry.args = []string{}
+	}
+	if entry.clientIds == nil {
+		entry.clientIds = []uint64{}
+	}
+	if entry.roomIds == nil {
+		entry.roomIds = []string{}
+	}
+
+	line, _ := sjson.Set(`{}`, "timestamp", time.Now().UnixMilli())
+	line, _ = sjson.Set(line, "action", entry.action)
+	line, _ = sjson.Set(line, "args", entry.args)
+	line, _ = sjson.Set(line, "operator", entry.operator.name)
+	if entry.operator.claimed != "" && entry.operator.claimed != entry.operator.name {
+		line, _ = sjson.Set(line, "claimedOperator", entry.operator.claimed)
+	}
+	line, _ = sjson.Set(line, "source", entry.operator.source)
+	line, _ = sjson.Set(line, "clientIds", entry.clientIds)
+	line, _ = sjson.Set(line, "roomIds", entry.roomIds)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	file, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Println("Error opening audit log:", err)
+		return
+	}
+	defer file.Close()
+
+	if _, err := file.WriteString(line + "\n"); err != nil {
+		log.Println("Error writing audit log:", err)
+	}
+}
+
+// Returns the last limit entries matching the filter, oldest first. An empty
+// field matches everything, otherwise field is one of action, operator,
+// source, client or room.
+func (a *AuditLog) query(field string, value string, limit int) ([]string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	file, err := os.Open(a.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	entries := []string{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, INITIAL_SCAN_BUFFER), MAX_PACKET_SIZE)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !gjson.Valid(line) || !auditEntryMatches(line, field, value) {
+			continue
+		}
+
+		entries = append(entries, line)
+		if limit > 0 && len(entries) > limit {
+			entries = entries[1:]
+		}
+	}
+
+	return entries, scanner.Err()
+}
+
+func auditEntryMatches(line string, field string, value string) bool {
+	switch field {
+	case "":
+		return true
+	case "action", "operator", "source":
+		return gjson.Get(line, field).String() == value
+	case "client":
+		for _, clientId := range gjson.Get(line, "clientIds").Array() {
+			if clientId.String() == value {
+				return true
+			}
+		}
+	case "room":
+		for _, roomId := range gjson.Get(line, "roomIds").Array() {
+			if roomId.String() == value {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func formatAuditEntry(line string) string {
+	timestamp := time.UnixMilli(gjson.Get(line, "timestamp").Int()).Format(time.DateTime)
+	args := []string{}
+	for _, arg := range gjson.Get(line, "args").Array() {
+		args = append(args, arg.String())
+	}
+
+	operator := Operator{name: gjson.Get(line, "operator").String(), claimed: gjson.Get(line, "claimedOperator").String()}
+
+	return fmt.Sprintf("%s %s/%s %s [%s] clients=%s rooms=%s",
+		timestamp,
+		gjson.Get(line, "source").String(),
+		operator,
+		gjson.Get(line, "action").String(),
+		strings.Join(args, " "),
+		gjson.Get(line, "clientIds").Raw,
+		gjson.Get(line, "roomIds").Raw,
+	)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+var BANS_FILE = dataPath("bans.json")
+
+type Ban struct {
+	id       uint64
+	clientId uint64 // 0 when the ban only matches by IP
+	ip       string // Empty when the ban only matches by client id
+	reason   string
+	operator string
+	created  time.Time
+	expires  time.Time // Zero for permanent bans
+}
+
+type BanList struct {
+	path   string
+	bans   []*Ban
+	nextId uint64
+	mu     sync.Mutex // Mutex for safely updating bans
+}
+
+func NewBanList(path string) *BanList {
+	return &BanList{path: path, bans: []*Ban{}}
+}
+
+func (b *Ban) expired() bool {
+	return !b.expires.IsZero() && time.Now().After(b.expires)
+}
+
+func (b *Ban) message() string {
+	message := "You have been banned from this server"
+	if !b.expires.IsZero() {
+		message += " until " + b.expires.UTC().Format(time.RFC1123)
+	}
+	if b.reason != "" {
+		message += ". Reason: " + b.reason
+	}
+	return message
+}
+
+func (b *Ban) String() string {
+	target := []string{}
+	if b.clientId != 0 {
+		target = append(target, "client "+fmt.Sprint(b.clientId))
+	}
+	if b.ip != "" {
+		target = append(target, "ip "+b.ip)
+	}
+	expires := "never"
+	if !b.expires.IsZero() {
+		expires = b.expires.Format(time.DateTime)
+	}
+	return fmt.Sprintf("Ban %d: %s, by %s, expires %s, reason: %q", b.id, strings.Join(target, " & "), b.operator, expires, b.reason)
+}
+
+func (l *BanList) load() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	value, err := os.ReadFile(l.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if !gjson.ValidBytes(value) {
+		return fmt.Errorf("%s is not valid JSON", l.path)
+	}
+
+	l.bans = []*Ban{}
+	for _, entry := range gjson.ParseBytes(value).Array() {
+		ban := &Ban{
+			id:       entry.Get("id").Uint(),
+			clientId: entry.Get("clientId").Uint(),
+			ip:       entry.Get("ip").String(),
+			reason:   entry.Get("reason").String(),
+			operator: entry.Get("operator").String(),
+			created:  time.UnixMilli(entry.Get("created").Int()),
+		}
+		if expires := entry.Get("expires").Int(); expires != 0 {
+			ban.expires = time.UnixMilli(expires)
+		}
+		if ban.id > l.nextId {
+			l.nextId = ban.id
+		}
+		l.bans = append(l.bans, ban)
+	}
+
+	return nil
+}
+
+func (l *BanList) saveLocked() {
+	value := `[]`
+	for i, ban := range l.bans {
+		path := fmt.Sprint(i)
+		value, _ = sjson.Set(value, path+".id", ban.id)
+		value, _ = sjson.Set(value, path+".clientId", ban.clientId)
+		value, _ = sjson.Set(value, path+".ip", ban.ip)
+		value, _ = sjson.Set(value, path+".reason", ban.reason)
+		value, _ = sjson.Set(value, path+".operator", ban.operator)
+		value, _ = sjson.Set(value, path+".created", ban.created.UnixMilli())
+		var expires int64
+		if !ban.expires.IsZero() {
+			expires = ban.expires.UnixMilli()
+		}
+		value, _ = sjson.Set(value, path+".expires", expires)
+	}
+
+	if err := writeFileAtomic(l.path, []byte(value)); err != nil {
+		log.Println("Error writing bans file:", err)
+	}
+}
+
+// Drops expired bans, must be called with the mutex held
+func (l *BanList) pruneLocked() bool {
+	active := l.bans[:0]
+	for _, ban := range l.bans {
+		if !ban.expired() {
+			active = append(active, ban)
+		}
+	}
+	pruned := len(active) != len(l.bans)
+	l.bans = active
+	return pruned
+}
+
+func (l *BanList) add(ban *Ban) *Ban {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.pruneLocked()
+	l.nextId++
+	ban.id = l.nextId
+	ban.created = time.Now()
+	l.bans = append(l.bans, ban)
+	l.saveLocked()
+
+	return ban
+}
+
+func (l *BanList) remove(id uint64) *Ban {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for i, ban := range l.bans {
+		if ban.id == id {
+			l.bans = append(l.bans[:i], l.bans[i+1:]...)
+			l.pruneLocked()
+			l.saveLocked()
+			return ban
+		}
+	}
+
+	return nil
+}
+
+func (l *BanList) list() []*Ban {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.pruneLocked() {
+		l.saveLocked()
+	}
+
+	return append([]*Ban{}, l.bans...)
+}
+
+// Returns the first active ban matching either the client id or the IP
+func (l *BanList) match(clientId uint64, ip string) *Ban {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, ban := range l.bans {
+		if ban.expired() {
+			continue
+		}
+		if (ban.clientId != 0 && ban.clientId == clientId) || (ban.ip != "" && ban.ip == ip) {
+			return ban
+		}
+	}
+
+	return nil
+}
+
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// Like time.ParseDuration, with an additional "d" suffix for whole days
+func parseBanDuration(input string) (time.Duration, error) {
+	if days, found := strings.CutSuffix(input, "d"); found {
+		count, err := strconv.ParseUint(days, 10, 32)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(count) * 24 * time.Hour, nil
+	}
+
+	return time.ParseDuration(input)
+}
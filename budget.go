@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+)
+
+const OVER_BUDGET_MESSAGE = "This room is out of space on the server, your change was not saved"
+const ROOM_FULL_MESSAGE = "This room is out of space on the server, try again later"
+
+var errRoomFull = errors.New("room is out of space on the server")
+
+// Byte accounting covers Room.state, Team.state, Team.queue and Client.state.
+// Every write to one of them charges the difference in length to its room
+// and, until the room is removed, to the server.
+func (r *Room) charge(delta int) {
+	if delta == 0 {
+		return
+	}
+
+	r.usageMu.Lock()
+	defer r.usageMu.Unlock()
+	r.usage.Add(int64(delta))
+	if !r.released {
+		r.server.usage.Add(int64(delta))
+	}
+}
+
+// Takes the room's bytes out of the server total, called once the room is
+// removed. Later charges, like members disconnecting, only touch the room.
+func (r *Room) release() {
+	r.usageMu.Lock()
+	defer r.usageMu.Unlock()
+	if !r.released {
+		r.released = true
+		r.server.usage.Add(-r.usage.Load())
+	}
+}
+
+// Charges delta if the room can grow by that much within both budgets, in
+// one step so concurrent writers can't each pass the check and together go
+// over. Returns false without charging anything otherwise.
+func (r *Room) tryCharge(delta int) bool {
+	if delta <= 0 {
+		r.charge(delta)
+		return true
+	}
+
+	r.usageMu.Lock()
+	defer r.usageMu.Unlock()
+	if MAX_ROOM_BYTES > 0 && r.usage.Load()+int64(delta) > int64(MAX_ROOM_BYTES) {
+		return false
+	}
+	// Other rooms charge the server total concurrently
+	for !r.released {
+		total := r.server.usage.Load()
+		if MAX_TOTAL_BYTES > 0 && total+int64(delta) > int64(MAX_TOTAL_BYTES) {
+			return false
+		}
+		if r.server.usage.CompareAndSwap(total, total+int64(delta)) {
+			break
+		}
+	}
+	r.usage.Add(int64(delta))
+	return true
+}
+
+// Whether the room can grow by delta bytes within both budgets
+func (r *Room) fits(delta int) bool {
+	if delta <= 0 {
+		return true
+	}
+	if MAX_ROOM_BYTES > 0 && r.usage.Load()+int64(delta) > int64(MAX_ROOM_BYTES) {
+		return false
+	}
+	if MAX_TOTAL_BYTES > 0 && r.server.usage.Load()+int64(delta) > int64(MAX_TOTAL_BYTES) {
+		return false
+	}
+	return true
+}
+
+// Like tryCharge, but first makes space by evicting the saves of teams with
+// nobody online, least recently used first, as long as that would be enough.
+// except is never evicted. The caller charges the difference once it knows
+// the actual change. Must be called without holding any team mutex.
+func (r *Room) reserve(delta int, except *Team) bool {
+	if r.tryCharge(delta) {
+		return true
+	}
+
+	// Over the room budget, only this room's saves help
+	if MAX_ROOM_BYTES > 0 && r.usage.Load()+int64(delta) > int64(MAX_ROOM_BYTES) {
+		candidates := r.evictionCandidates(except)
+		if r.usage.Load()-evictable(candidates)+int64(delta) > int64(MAX_ROOM_BYTES) {
+			return false
+		}
+		for _, team := range candidates {
+			team.evict()
+			if r.usage.Load()+int64(delta) <= int64(MAX_ROOM_BYTES) {
+				break
+			}
+		}
+	}
+
+	if MAX_TOTAL_BYTES > 0 && r.server.usage.Load()+int64(delta) > int64(MAX_TOTAL_BYTES) {
+		candidates := []*Team{}
+		r.server.rooms.Range(func(_, value interface{}) bool {
+			candidates = append(candidates, value.(*Room).evictionCandidates(except)...)
+			return true
+		})
+		if r.server.usage.Load()-evictable(candidates)+int64(delta) > int64(MAX_TOTAL_BYTES) {
+			return false
+		}
+		sort.Slice(candidates, func(i, j int) bool { return candidates[i].lastUsed().Before(candidates[j].lastUsed()) })
+
+		for _, team := range candidates {
+			team.evict()
+			if r.server.usage.Load()+int64(delta) <= int64(MAX_TOTAL_BYTES) {
+				break
+			}
+		}
+	}
+
+	return r.tryCharge(delta)
+}
+
+// Teams in the room holding a save or queue with no member online, least
+// recently used first
+func (r *Room) evictionCandidates(except *Team) []*Team {
+	online := make(map[*Team]bool)
+	r.clients.Range(func(_, value interface{}) bool {
+		client := value.(*Client)
+		client.mu.Lock()
+		if client.conn != nil {
+			online[client.team] = true
+		}
+		client.mu.Unlock()
+		return true
+	})
+
+	candidates := []*Team{}
+	r.teams.Range(func(_, value interface{}) bool {
+		team := value.(*Team)
+		if team != except && !online[team] && team.usage() > 0 {
+			candidates = append(candidates, team)
+		}
+		return true
+	})
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].lastUsed().Before(candidates[j].lastUsed()) })
+
+	return candidates
+}
+
+// Bytes that evicting all of the teams would free
+func evictable(teams []*Team) int64 {
+	var total int64
+	for _, team := range teams {
+		total += int64(team.usage())
+	}
+	return total
+}
+
+// Drops the team's save and queue, telling the room about it
+func (t *Team) evict() {
+	t.mu.Lock()
+	freed := t.usageLocked()
+	t.state = "{}"
+	t.queue = []string{}
+	t.queueKeys = []string{}
+	t.droppedFromQueue = 0
+	t.mu.Unlock()
+
+	if freed == 0 {
+		return
+	}
+	t.room.charge(-freed)
+
+	log.Printf("Evicted the save of team %s in room %s to free %d bytes\n", t.id, t.room.id, freed)
+	message := fmt.Sprintf("The saved progress of team %s was removed to free up space on the server", t.id)
+	t.room.clients.Range(func(_, value interface{}) bool {
+		sendServerMessage(value.(*Client), message)
+		return true
+	})
+}
+
+// Bytes held by the save and queue, must be called with the mutex held
+func (t *Team) usageLocked() int {
+	usage := 0
+	if t.state != "{}" {
+		usage += len(t.state)
+	}
+	for _, packet := range t.queue {
+		usage += len(packet)
+	}
+	return usage
+}
+
+func (t *Team) usage() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.usageLocked()
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTryCharge(t *testing.T) {
+	tests := []struct {
+		name       string
+		roomBytes  int
+		totalBytes int
+		delta      int
+		want       bool
+	}{
+		{name: "within both budgets", roomBytes: 100, totalBytes: 100, delta: 50, want: true},
+		{name: "over the room budget", roomBytes: 60, totalBytes: 1000, delta: 50, want: false},
+		{name: "over the total budget", roomBytes: 1000, totalBytes: 60, delta: 50, want: false},
+		{name: "shrinking always fits", roomBytes: 1, totalBytes: 1, delta: -5, want: true},
+		{name: "zero means no limit", roomBytes: 0, totalBytes: 0, delta: 1 << 30, want: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setTestBudgets(t, 0, 0)
+			room := newTestRoom(t)
+			room.charge(20 - int(room.usage.Load()))
+
+			setTestBudgets(t, test.roomBytes, test.totalBytes)
+			if got := room.tryCharge(test.delta); got != test.want {
+				t.Errorf("tryCharge(%d) with 20 bytes held = %t, want %t", test.delta, got, test.want)
+			}
+			want := int64(20)
+			if test.want {
+				want += int64(test.delta)
+			}
+			if room.usage.Load() != want || room.server.usage.Load() != want {
+				t.Errorf("room holds %d and server %d bytes, want %d", room.usage.Load(), room.server.usage.Load(), want)
+			}
+		})
+	}
+}
+
+func TestTryChargeConcurrent(t *testing.T) {
+	setTestBudgets(t, 0, 0)
+	server := NewServer()
+	rooms := []*Room{}
+	for i := 0; i < 4; i++ {
+		room := NewRoom(server, fmt.Sprint(i), 1, `{"roomState":{}}`)
+		server.rooms.Store(room.id, room)
+		rooms = append(rooms, room)
+	}
+
+	setTestBudgets(t, 0, 1000)
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(room *Room) {
+			defer wg.Done()
+			room.tryCharge(30)
+		}(rooms[i%len(rooms)])
+	}
+	wg.Wait()
+
+	if total := server.usage.Load(); total > 1000 {
+		t.Errorf("concurrent writers brought the server to %d bytes, over the 1000 byte budget", total)
+	}
+}
+
+func TestReserveEviction(t *testing.T) {
+	save := `{"save":"` + strings.Repeat("x", 89) + `"}` // 100 bytes
+
+	tests := []struct {
+		name        string
+		roomBytes   int
+		delta       int
+		onlineTeams []string
+		want        bool
+		wantEvicted []string
+	}{
+		{
+			name:        "fits without evicting",
+			roomBytes:   1000,
+			delta:       100,
+			want:        true,
+			wantEvicted: []string{},
+		},
+		{
+			name:        "evicts the least recently used offline save first",
+			roomBytes:   350,
+			delta:       100,
+			want:        true,
+			wantEvicted: []string{"old"},
+		},
+		{
+			name:        "evicts as many saves as needed",
+			roomBytes:   350,
+			delta:       200,
+			want:        true,
+			wantEvicted: []string{"old", "middle"},
+		},
+		{
+			name:        "never evicts a team with someone online",
+			roomBytes:   350,
+			delta:       100,
+			onlineTeams: []string{"old"},
+			want:        true,
+			wantEvicted: []string{"middle"},
+		},
+		{
+			name:        "evicts nothing when eviction wouldn't be enough",
+			roomBytes:   350,
+			delta:       400,
+			want:        false,
+			wantEvicted: []string{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setTestBudgets(t, 0, 0)
+			room := newTestRoom(t)
+			room.charge(-int(room.usage.Load()))
+
+			// "writer" is the team asking for space and is never evicted
+			now := time.Now()
+			teams := map[string]time.Time{"old": now.Add(-3 * time.Hour), "middle": now.Add(-2 * time.Hour), "writer": now.Add(-4 * time.Hour)}
+			for id, used := range teams {
+				team := room.findOrCreateTeam(id)
+				team.replaceState(save)
+				team.used = used
+			}
+			for i, id := range test.onlineTeams {
+				addTestClient(t, room, uint64(i+1), room.findOrCreateTeam(id), true)
+			}
+
+			setTestBudgets(t, test.roomBytes, 0)
+			writer := room.findOrCreateTeam("writer")
+			if got := room.reserve(test.delta, writer); got != test.want {
+				t.Fatalf("reserve(%d) = %t, want %t", test.delta, got, test.want)
+			}
+
+			evicted := []string{}
+			for _, id := range []string{"old", "middle", "writer"} {
+				if room.findOrCreateTeam(id).usage() == 0 {
+					evicted = append(evicted, id)
+				}
+			}
+			if strings.Join(evicted, ",") != strings.Join(test.wantEvicted, ",") {
+				t.Errorf("evicted %v, want %v", evicted, test.wantEvicted)
+			}
+			// A successful reserve charges the delta
+			held := int64(3-len(evicted)) * int64(len(save))
+			if test.want {
+				held += int64(test.delta)
+			}
+			if room.usage.Load() != held {
+				t.Errorf("room holds %d bytes after eviction, want %d", room.usage.Load(), held)
+			}
+		})
+	}
+}
+
+func TestRemovedRoomLeavesServerTotal(t *testing.T) {
+	room := newTestRoom(t)
+	client := addTestClient(t, room, 1, room.findOrCreateTeam(""), true)
+	room.charge(len(client.state))
+
+	room.server.removeRoom(room)
+	if total := room.server.usage.Load(); total != 0 {
+		t.Fatalf("server holds %d bytes after the room was removed", total)
+	}
+
+	client.disconnect()
+	if total := room.server.usage.Load(); total != 0 {
+		t.Errorf("a disconnect after removal brought the server total to %d", total)
+	}
+}
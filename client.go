@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"net"
 	"sync"
@@ -11,21 +12,47 @@ import (
 )
 
 const sendQueueSize = 256
+const MAX_CHAT_PACKET_SIZE = 4 * 1024
 
 type Client struct {
 	id           uint64
 	conn         net.Conn
 	sendCh       chan string // Outgoing packet queue, drained by the connection's writeLoop
 	server       *Server
-	room         *Room
+	room         *Room // Only changes with JOIN_ROOM, other goroutines read it with getRoom
 	team         *Team
 	state        string     // Client state, current scene, etc.
+	game         string     // Game the client is running, from its handshake
 	mu           sync.Mutex // Mutex for safely updating state
-	lastActivity time.Time
+	lastActivity time.Time  // Last packet that counts as activity in the room
+	lastSeen     time.Time  // Last packet of any kind, liveness replies included
+	offlineSince time.Time  // When conn was last dropped
+	pinned       bool       // Kept in the room however long it is offline
+	removed      bool       // Pruned from the room, a reconnect gets a new entry
+
+	// Heartbeat bookkeeping, reset for every new connection. Only clients that
+	// have acked at least once are held to MAX_MISSED_HEARTBEATS, older clients
+	// never reply.
+	heartbeatSeq     uint64
+	heartbeatAcked   uint64
+	acksHeartbeats   bool
+	missedHeartbeats int
+
+	// Round trip time, smoothed over PING/PONG exchanges
+	pingSeq    uint64
+	pingSentAt time.Time
+	rtt        time.Duration
 }
 
 func (c *Client) attachConnLocked(conn net.Conn) {
 	c.conn = conn
+	c.lastSeen = time.Now()
+	c.heartbeatSeq = 0
+	c.heartbeatAcked = 0
+	c.acksHeartbeats = false
+	c.missedHeartbeats = 0
+	c.pingSeq = 0
+	c.rtt = 0
 	c.sendCh = make(chan string, sendQueueSize)
 	go c.writeLoop(conn, c.sendCh)
 }
@@ -48,36 +75,131 @@ func (c *Client) writeLoop(conn net.Conn, ch chan string) {
 			c.disconnectConn(conn)
 			return
 		}
-
-		c.mu.Lock()
-		c.lastActivity = time.Now()
-		c.mu.Unlock()
 	}
 }
 
 func (c *Client) handlePacket(packet string) {
+	received := time.Now()
+	packetType := gjson.Get(packet, "type").String()
+
 	c.mu.Lock()
-	c.lastActivity = time.Now()
+	c.lastSeen = received
 	c.mu.Unlock()
 
-	packetType := gjson.Get(packet, "type").String()
+	// Liveness replies keep the connection alive but don't count as activity
+	// in the room, so a client idling in a menu still lets the room go idle
+	if packetType == "HEARTBEAT_ACK" {
+		c.ackHeartbeat(gjson.Get(packet, "seq").Uint())
+		return
+	}
+	if packetType == "PONG" {
+		c.recordPong(gjson.Get(packet, "seq").Uint())
+		return
+	}
+	if packetType == "TIME_SYNC" {
+		c.replyTimeSync(packet, received)
+		return
+	}
+
+	c.mu.Lock()
+	c.lastActivity = time.Now()
+	c.missedHeartbeats = 0
+	c.mu.Unlock()
 
 	if !c.server.quietMode.Load() && !gjson.Get(packet, "quiet").Exists() {
 		log.Printf("Client %d -> Server: %s\n", c.id, packetType)
 	}
 
 	if packetType == "UPDATE_CLIENT_STATE" {
+		filtered := c.server.filter.Load().filterClientState(packet, "state.")
+		filtered.log(fmt.Sprintf("client %d", c.id))
+		if filtered.rejected {
+			sendServerMessage(c, FILTER_REJECT_MESSAGE)
+			return
+		}
+		packet = filtered.packet
+
 		team := c.room.findOrCreateTeam(gjson.Get(packet, "state.teamId").String())
 
+		state, _ := sjson.Set(gjson.Get(packet, "state").Raw, "clientId", c.id)
+
 		c.mu.Lock()
-		c.state = gjson.Get(packet, "state").Raw
-		c.state, _ = sjson.Set(c.state, "clientId", c.id)
+		if !c.room.tryCharge(len(state) - len(c.state)) {
+			c.mu.Unlock()
+			sendServerMessage(c, OVER_BUDGET_MESSAGE)
+			return
+		}
+		c.state = state
 		c.team = team
 		c.mu.Unlock()
 	}
 
+	if packetType == "CHAT_MESSAGE" {
+		if len(packet) > MAX_CHAT_PACKET_SIZE {
+			log.Printf("Client %d sent a %d byte chat message, over the %d byte limit, dropping it", c.id, len(packet), MAX_CHAT_PACKET_SIZE)
+			return
+		}
+
+		filtered := c.server.filter.Load().filterChat(packet)
+		filtered.log(fmt.Sprintf("client %d", c.id))
+		if filtered.rejected {
+			sendServerMessage(c, FILTER_REJECT_MESSAGE)
+			return
+		}
+		packet = filtered.packet
+
+		packet, _ = sjson.Set(packet, "clientId", c.id)
+		packet, _ = sjson.Set(packet, "timestamp", time.Now().UnixMilli())
+		c.room.addChatMessage(packet)
+		c.room.broadcastPacket(packet)
+		return
+	}
+
+	if packetType == "JOIN_ROOM" {
+		c.joinRoom(packet)
+		return
+	}
+
+	if packetType == "PIN_CLIENT" {
+		c.pinClient(packet)
+		return
+	}
+
+	if packetType == "START_RACE" {
+		c.startRace(packet)
+		return
+	}
+
+	if packetType == "REQUEST_LEADERBOARD" {
+		game := gjson.Get(packet, "game").String()
+		if game == "" {
+			c.mu.Lock()
+			game = c.game
+			c.mu.Unlock()
+		}
+
+		entries := c.server.completions.leaderboard(game, leaderboardLimit(int(gjson.Get(packet, "limit").Int())))
+		outgoingPacket, _ := sjson.Set(`{"type":"LEADERBOARD"}`, "game", game)
+		outgoingPacket, _ = sjson.SetRaw(outgoingPacket, "entries", leaderboardJson(entries))
+		c.sendPacket(outgoingPacket)
+		return
+	}
+
 	if packetType == "GAME_COMPLETE" {
-		c.server.gameCompleteCount.Add(1)
+		// Only the first GAME_COMPLETE from a client in a room counts
+		completion := c.newCompletion()
+		if c.server.completions.record(completion) {
+			c.server.gameCompleteCount.Add(1)
+			c.server.games.addGameComplete(completion.game)
+
+			data, _ := sjson.SetRaw(`{}`, "completion", completion.toJson())
+			data, _ = sjson.Set(data, "clientId", c.id)
+			data, _ = sjson.Set(data, "roomId", completion.roomId)
+			data, _ = sjson.Set(data, "teamId", completion.teamId)
+			data, _ = sjson.Set(data, "game", completion.game)
+			c.server.webhooks.emit(EVENT_GAME_COMPLETE, data)
+		}
+		c.finishRace()
 	}
 
 	targetClientId := gjson.Get(packet, "targetClientId")
@@ -86,7 +208,7 @@ func (c *Client) handlePacket(packet string) {
 		value, ok := c.room.clients.Load(targetClientId.Uint())
 		if ok {
 			targetClient := value.(*Client)
-			targetClient.sendPacket(packet)
+			targetClient.sendPacket(stampServerTime(packet))
 		}
 		return
 	}
@@ -126,6 +248,7 @@ func (c *Client) handlePacket(packet string) {
 		}
 		withQueue, _ := sjson.Set(outgoingPacket, "queue", team.queue)
 		queued := len(team.queue)
+		team.used = time.Now()
 		team.mu.Unlock()
 
 		if len(withQueue) <= MAX_PACKET_SIZE {
@@ -144,14 +267,13 @@ func (c *Client) handlePacket(packet string) {
 
 		team := c.room.findOrCreateTeam(targetTeamId.String())
 
-		team.mu.Lock()
-		clientIdsRequestingState := team.clientIdsRequestingState
-		team.state = gjson.Get(packet, "state").Raw
-		team.queue = []string{}
-		team.droppedFromQueue = 0
-		team.clientIdsRequestingState = []uint64{}
-		team.mu.Unlock()
+		clientIdsRequestingState, stored := team.replaceState(gjson.Get(packet, "state").Raw)
+		if !stored {
+			// Teammates waiting on it still get the save, it just isn't kept
+			sendServerMessage(c, OVER_BUDGET_MESSAGE)
+		}
 
+		packet = stampServerTime(packet)
 		for _, clientId := range clientIdsRequestingState {
 			if value, ok := c.room.clients.Load(clientId); ok {
 				client := value.(*Client)
@@ -159,17 +281,29 @@ func (c *Client) handlePacket(packet string) {
 			}
 		}
 
-	} else if packetType == "UPDATE_ROOM_STATE" {
-		c.room.mu.Lock()
-		c.room.state = gjson.Get(packet, "state").Raw
-		c.room.mu.Unlock()
-		c.room.broadcastPacket(packet)
+	} else if packetType == "PATCH_TEAM_STATE" {
+		if !targetTeamId.Exists() {
+			return
+		}
+
+		// Applied to the stored save instead of queued, so it stays current
+		team := c.room.findOrCreateTeam(targetTeamId.String())
+		if err := team.patchState(packet); err != nil {
+			rejected, _ := sjson.Set(`{"type":"TEAM_STATE_REJECTED"}`, "targetTeamId", team.id)
+			rejected, _ = sjson.Set(rejected, "reason", err.Error())
+			c.sendPacket(rejected)
+			return
+		}
+
+		team.broadcastPacket(packet)
+	} else if packetType == "UPDATE_ROOM_STATE" || packetType == "PATCH_ROOM_STATE" {
+		c.updateRoomState(packetType, packet)
 	} else if targetTeamId.Exists() {
 		team := c.room.findOrCreateTeam(targetTeamId.String())
 		addToQueue := gjson.Get(packet, "addToQueue")
 
-		if addToQueue.Exists() && addToQueue.Bool() {
-			team.enqueue(packet)
+		if addToQueue.Exists() && addToQueue.Bool() && !team.enqueue(packet) {
+			sendServerMessage(c, OVER_BUDGET_MESSAGE)
 		}
 
 		team.broadcastPacket(packet)
@@ -178,6 +312,12 @@ func (c *Client) handlePacket(packet string) {
 	}
 }
 
+func (c *Client) getRoom() *Room {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.room
+}
+
 func (c *Client) sendPacket(packet string) {
 	if !c.server.quietMode.Load() && !gjson.Get(packet, "quiet").Exists() {
 		log.Printf("Client %d <- Server: %s\n", c.id, gjson.Get(packet, "type").String())
@@ -204,6 +344,102 @@ func (c *Client) sendPacket(packet string) {
 	}
 }
 
+// Sends the next heartbeat if nothing has been heard from the client for a
+// while, returns false once the client has missed too many acks and should be
+// dropped
+func (c *Client) heartbeat() bool {
+	c.mu.Lock()
+	if time.Since(c.lastSeen) <= HEARTBEAT {
+		c.mu.Unlock()
+		return true
+	}
+	if c.acksHeartbeats && c.heartbeatAcked < c.heartbeatSeq {
+		c.missedHeartbeats++
+	}
+	if MAX_MISSED_HEARTBEATS > 0 && c.missedHeartbeats >= MAX_MISSED_HEARTBEATS {
+		c.mu.Unlock()
+		return false
+	}
+	c.heartbeatSeq++
+	packet, _ := sjson.Set(`{"type":"HEARTBEAT","quiet":true}`, "seq", c.heartbeatSeq)
+	c.mu.Unlock()
+
+	c.sendPacket(packet)
+	return true
+}
+
+func (c *Client) ackHeartbeat(seq uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.acksHeartbeats = true
+	c.missedHeartbeats = 0
+	if seq > c.heartbeatAcked {
+		c.heartbeatAcked = seq
+	}
+}
+
+func (c *Client) ping() {
+	c.mu.Lock()
+	c.pingSeq++
+	c.pingSentAt = time.Now()
+	packet, _ := sjson.Set(`{"type":"PING","quiet":true}`, "seq", c.pingSeq)
+	c.mu.Unlock()
+
+	c.sendPacket(packet)
+}
+
+// Folds a PONG into the smoothed RTT the same way TCP does, replies to
+// anything but the latest PING are ignored
+func (c *Client) recordPong(seq uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if seq != c.pingSeq || c.pingSentAt.IsZero() {
+		return
+	}
+
+	c.missedHeartbeats = 0
+	sample := time.Since(c.pingSentAt)
+	c.pingSentAt = time.Time{}
+	if c.rtt == 0 {
+		c.rtt = sample
+	} else {
+		c.rtt = (7*c.rtt + sample) / 8
+	}
+}
+
+func (c *Client) getRtt() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.rtt
+}
+
+// How long the connection may go without a packet before it is considered
+// dead, zero if the client isn't held to heartbeat acks
+func (c *Client) readTimeout() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.acksHeartbeats || MAX_MISSED_HEARTBEATS <= 0 {
+		return 0
+	}
+	return HEARTBEAT * time.Duration(MAX_MISSED_HEARTBEATS+1)
+}
+
+// Wakes the connection's reader so handleConnection tears the session down
+// and tells the room right away, instead of waiting on a half-open socket
+func (c *Client) expireConn() {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+
+	if conn != nil {
+		conn.SetReadDeadline(time.Now())
+	}
+}
+
 func (c *Client) disconnect() {
 	c.mu.Lock()
 	conn := c.conn
@@ -222,9 +458,12 @@ func (c *Client) disconnectConn(conn net.Conn) {
 		c.mu.Unlock()
 		return
 	}
+	before := len(c.state)
 	c.state, _ = sjson.Set(c.state, "online", false)
 	c.state, _ = sjson.Set(c.state, "isSaveLoaded", false)
+	c.room.charge(len(c.state) - before)
 	c.conn = nil
+	c.offlineSince = time.Now()
 	if c.sendCh != nil {
 		close(c.sendCh)
 		c.sendCh = nil
@@ -234,10 +473,65 @@ func (c *Client) disconnectConn(conn net.Conn) {
 	c.server.onlineClients.Delete(c.id)
 }
 
+// Replays the room's recent chat, flagged so clients can tell it apart from live messages
+func (c *Client) sendChatHistory() {
+	for _, packet := range c.room.getChatHistory() {
+		packet, _ = sjson.Set(packet, "history", true)
+		c.sendPacket(packet)
+	}
+}
+
 func (c *Client) sendRoomState() {
 	c.room.mu.Lock()
 	packet, _ := sjson.SetRaw(`{"type":"UPDATE_ROOM_STATE"}`, "state", c.room.state)
+	packet, _ = sjson.Set(packet, "version", c.room.version)
 	c.room.mu.Unlock()
 
 	c.sendPacket(packet)
 }
+
+// Applies an UPDATE_ROOM_STATE or PATCH_ROOM_STATE, relays the resulting
+// state to the rest of the room and acks the new version to the sender:
+//
+//	-> {"type":"PATCH_ROOM_STATE","baseVersion":3,"mergePatch":{"logic":{"rainbowBridge":null}}}
+//	-> {"type":"PATCH_ROOM_STATE","ops":[{"op":"set","path":"logic.shuffleSongs","value":true}]}
+//	<- {"type":"ROOM_STATE_ACK","version":4}
+//	<- {"type":"ROOM_STATE_REJECTED","reason":"...","version":3,"state":{...}}
+//
+// A plain UPDATE_ROOM_STATE without a baseVersion comes from a client that
+// doesn't know about versions, it gets no ack and a SERVER_MESSAGE if rejected.
+func (c *Client) updateRoomState(packetType string, packet string) {
+	versioned := packetType == "PATCH_ROOM_STATE" || gjson.Get(packet, "baseVersion").Exists()
+
+	state, version, err := c.room.updateState(c.id, gjson.Get(packet, "baseVersion"), func(state string) (string, error) {
+		if packetType == "PATCH_ROOM_STATE" {
+			return applyPatchPacket(state, packet)
+		}
+		return gjson.Get(packet, "state").Raw, nil
+	})
+	if err != nil {
+		if !versioned {
+			sendServerMessage(c, "Room settings were not changed: "+err.Error())
+			return
+		}
+		rejected, _ := sjson.Set(`{"type":"ROOM_STATE_REJECTED"}`, "reason", err.Error())
+		rejected, _ = sjson.Set(rejected, "version", version)
+		rejected, _ = sjson.SetRaw(rejected, "state", state)
+		c.sendPacket(rejected)
+		return
+	}
+
+	outgoingPacket, _ := sjson.Delete(packet, "baseVersion")
+	if packetType == "PATCH_ROOM_STATE" {
+		// Clients without patch support still get the full state
+		outgoingPacket, _ = sjson.Set(`{"type":"UPDATE_ROOM_STATE"}`, "clientId", c.id)
+	}
+	outgoingPacket, _ = sjson.SetRaw(outgoingPacket, "state", state)
+	outgoingPacket, _ = sjson.Set(outgoingPacket, "version", version)
+	c.room.broadcastPacket(outgoingPacket)
+
+	if versioned {
+		ack, _ := sjson.Set(`{"type":"ROOM_STATE_ACK"}`, "version", version)
+		c.sendPacket(ack)
+	}
+}
@@ -0,0 +1,591 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// An admin command, runnable from stdin or the control socket
+type Command struct {
+	name      string
+	usage     string // Arguments, <required> and [optional]
+	help      string
+	minArgs   int
+	secretArg int // Position of an argument kept out of logs, like a password, 0 for none
+	run       func(s *Server, ctx *CommandContext, args []string) error
+}
+
+// Per invocation state handed to a command. Human readable output goes in
+// output, anything a script may want goes in data as raw JSON.
+type CommandContext struct {
+	operator Operator
+	output   strings.Builder
+	data     string
+	stop     bool // Shut the server down once the reply has been delivered
+}
+
+func (ctx *CommandContext) println(a ...interface{}) {
+	ctx.output.WriteString(fmt.Sprintln(a...))
+}
+
+func (ctx *CommandContext) printf(format string, a ...interface{}) {
+	ctx.output.WriteString(fmt.Sprintf(format, a...))
+}
+
+func (ctx *CommandContext) set(path string, value interface{}) {
+	ctx.data, _ = sjson.Set(ctx.data, path, value)
+}
+
+func (ctx *CommandContext) setRaw(path string, value string) {
+	ctx.data, _ = sjson.SetRaw(ctx.data, path, value)
+}
+
+var commands []*Command
+
+func init() {
+	commands = []*Command{
+		{name: "help", usage: "[command]", help: "Show this help message", run: runHelp},
+		{name: "stats", help: "Print server stats", run: runStats},
+		{name: "history", usage: "<minute|hour|day> [count]", help: "Show peak and average online, rooms, new clients and games completed over time", minArgs: 1, run: runHistory},
+		{name: "leaderboard", usage: "<game> [count]", help: "Show the fastest completions of a game, one per team", minArgs: 1, run: runLeaderboard},
+		{name: "quiet", help: "Toggle quiet mode", run: runQuiet},
+		{name: "roomCount", help: "Show the number of rooms", run: runRoomCount},
+		{name: "clientCount", help: "Show the number of clients", run: runClientCount},
+		{name: "list", help: "List all rooms and clients", run: runList},
+		{name: "audit", usage: "[action|operator|source|client|room <value>] [count]", help: "Show recent admin actions", run: runAudit},
+		{name: "stop", usage: "[message]", help: "Stop the server", run: runStop},
+		{name: "message", usage: "<selector> [message]", help: "Send a message to the selected clients", minArgs: 1, run: targetedCommand("message")},
+		{name: "messageAll", usage: "[message]", help: "Send a message to all clients", run: allCommand("messageAll")},
+		{name: "disable", usage: "<selector> [message]", help: "Disable anchor on the selected clients", minArgs: 1, run: targetedCommand("disable")},
+		{name: "disableAll", usage: "[message]", help: "Disable anchor on all clients", run: allCommand("disableAll")},
+		{name: "kick", usage: "<selector> [message]", help: "Disconnect the selected clients with a message", minArgs: 1, run: targetedCommand("kick")},
+		{name: "deleteRoom", usage: "<roomId>", help: "Disables anchor on all online clients in the room and deletes it", minArgs: 1, run: runDeleteRoom},
+		{name: "reserve", usage: "<roomId> [password|-]", help: "Reserve a room so it is never cleaned up, or change its password, - removes it. Starts from the room's current state", minArgs: 1, secretArg: 2, run: runReserve},
+		{name: "unreserve", usage: "<roomId>", help: "Remove a room's reservation, it is cleaned up like any other room again", minArgs: 1, run: runUnreserve},
+		{name: "reserved", help: "List reserved rooms", run: runReserved},
+		{name: "roomPreset", usage: "<roomId> <roomState JSON>", help: "Set a reserved room's preset state and apply it to the room", minArgs: 2, run: runRoomPreset},
+		{name: "ban", usage: "<clientId|ip> [duration] [reason]", help: "Ban a client and its current IP, or an IP, e.g. duration 12h or 7d", minArgs: 1, run: runBan},
+		{name: "unban", usage: "<banId>", help: "Remove a ban", minArgs: 1, run: runUnban},
+		{name: "bans", help: "List active bans", run: runBans},
+		{name: "reloadFilter", help: "Reload the word filter from filter.json", run: runReloadFilter},
+	}
+}
+
+func findCommand(name string) *Command {
+	for _, command := range commands {
+		if command.name == name {
+			return command
+		}
+	}
+	return nil
+}
+
+// Runs a command line already split into fields, returning its context with
+// the output filled in
+func (s *Server) runCommand(operator Operator, input []string) (*CommandContext, error) {
+	ctx := &CommandContext{operator: operator, data: "{}"}
+
+	if len(input) == 0 {
+		return ctx, runHelp(s, ctx, nil)
+	}
+
+	command := findCommand(input[0])
+	if command == nil {
+		return ctx, fmt.Errorf("unknown command %q, try help", input[0])
+	}
+
+	args := input[1:]
+	if len(args) < command.minArgs {
+		return ctx, fmt.Errorf("usage: %s %s", command.name, command.usage)
+	}
+
+	return ctx, command.run(s, ctx, args)
+}
+
+// Copy of the input with the command's secret argument masked, for logging
+func redactCommand(input []string) []string {
+	if len(input) == 0 {
+		return input
+	}
+	command := findCommand(input[0])
+	if command == nil || command.secretArg == 0 || len(input) <= command.secretArg {
+		return input
+	}
+
+	redacted := append([]string{}, input...)
+	redacted[command.secretArg] = "[redacted]"
+	return redacted
+}
+
+func runHelp(s *Server, ctx *CommandContext, args []string) error {
+	if len(args) > 0 {
+		command := findCommand(args[0])
+		if command == nil {
+			return fmt.Errorf("unknown command %q", args[0])
+		}
+		ctx.printf("%s %s: %s\n", command.name, command.usage, command.help)
+		if strings.Contains(command.usage, "<selector>") {
+			ctx.printf("Selectors: %s\n", SELECTOR_HELP)
+		}
+		return nil
+	}
+
+	ctx.println("Available commands:")
+	for _, command := range commands {
+		if command.usage == "" {
+			ctx.printf("%s: %s\n", command.name, command.help)
+		} else {
+			ctx.printf("%s %s: %s\n", command.name, command.usage, command.help)
+		}
+	}
+	ctx.printf("Selectors: %s\n", SELECTOR_HELP)
+	return nil
+}
+
+func runStats(s *Server, ctx *CommandContext, _ []string) error {
+	ctx.set("gameCompleteCount", s.gameCompleteCount.Load())
+	ctx.set("uniqueCount", s.nextClientId.Load())
+	ctx.set("onlineCount", s.onlineCount())
+	ctx.set("averageRtt", s.averageRtt())
+	ctx.set("usageBytes", s.usage.Load())
+	games := s.gameStatsJson()
+	ctx.setRaw("games", games)
+
+	ctx.println("Games Complete:", s.gameCompleteCount.Load())
+	ctx.println("Unique Clients:", s.nextClientId.Load())
+	ctx.println("Online Clients:", s.onlineCount())
+	ctx.printf("Average RTT: %dms\n", s.averageRtt())
+	ctx.printf("State Held: %d bytes\n", s.usage.Load())
+	gjson.Parse(games).ForEach(func(game, counts gjson.Result) bool {
+		ctx.printf("  %s: %d online, %d unique, %d complete\n", game.String(),
+			counts.Get("onlineCount").Int(), counts.Get("uniqueCount").Uint(), counts.Get("gameCompleteCount").Uint())
+		return true
+	})
+	return nil
+}
+
+func runHistory(s *Server, ctx *CommandContext, args []string) error {
+	limit := 24
+	if len(args) > 1 {
+		parsed, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("count must be a number, got %q", args[1])
+		}
+		limit = parsed
+	}
+
+	buckets, err := s.history.query(args[0], limit)
+	if err != nil {
+		return err
+	}
+
+	ctx.data = "[]"
+	for i, bucket := range buckets {
+		path := fmt.Sprint(i)
+		ctx.set(path+".start", bucket.start.UnixMilli())
+		ctx.set(path+".peakOnline", bucket.peakOnline)
+		ctx.set(path+".averageOnline", bucket.averageOnline())
+		ctx.set(path+".peakRooms", bucket.peakRooms)
+		ctx.set(path+".averageRooms", bucket.averageRooms())
+		ctx.set(path+".newUnique", bucket.newUnique)
+		ctx.set(path+".gameCompletes", bucket.gameCompletes)
+		ctx.printf("%s  online %d peak / %.1f avg  rooms %d peak / %.1f avg  new clients %d  games complete %d\n",
+			bucket.start.Format("2006-01-02 15:04"), bucket.peakOnline, bucket.averageOnline(),
+			bucket.peakRooms, bucket.averageRooms(), bucket.newUnique, bucket.gameCompletes)
+	}
+	return nil
+}
+
+func runLeaderboard(s *Server, ctx *CommandContext, args []string) error {
+	limit := 0
+	if len(args) > 1 {
+		parsed, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("count must be a number, got %q", args[1])
+		}
+		limit = parsed
+	}
+
+	entries := s.completions.leaderboard(args[0], leaderboardLimit(limit))
+	ctx.data = leaderboardJson(entries)
+	for i, entry := range entries {
+		ctx.printf("%d. %s  room %s  team %s  clients %v  completed %s\n", i+1,
+			entry.elapsed.Truncate(time.Second), entry.roomId, entry.teamId, entry.members, entry.completedAt.Format(time.DateTime))
+	}
+	if len(entries) == 0 {
+		ctx.println("No completions recorded for", args[0])
+	}
+	return nil
+}
+
+func runQuiet(s *Server, ctx *CommandContext, _ []string) error {
+	s.quietMode.Store(!s.quietMode.Load())
+	ctx.set("quiet", s.quietMode.Load())
+	ctx.println("Quiet mode:", s.quietMode.Load())
+	return nil
+}
+
+func runRoomCount(s *Server, ctx *CommandContext, _ []string) error {
+	roomCount := s.roomCount()
+	ctx.set("roomCount", roomCount)
+	ctx.println("Room count:", roomCount)
+	return nil
+}
+
+func runClientCount(s *Server, ctx *CommandContext, _ []string) error {
+	clientCount := s.onlineCount()
+	ctx.set("clientCount", clientCount)
+	ctx.println("Client count:", clientCount)
+	return nil
+}
+
+func runList(s *Server, ctx *CommandContext, _ []string) error {
+	ctx.data = "[]"
+	roomIndex := 0
+	s.rooms.Range(func(_, value interface{}) bool {
+		room := value.(*Room)
+		roomPath := fmt.Sprint(roomIndex)
+		lifecycle := room.getLifecycle()
+		ctx.set(roomPath+".id", room.id)
+		ctx.set(roomPath+".lifecycle", lifecycle)
+		ctx.setRaw(roomPath+".clients", "[]")
+		ctx.println("Room", room.id, "("+lifecycle+"):")
+
+		clientIndex := 0
+		room.clients.Range(func(_, value interface{}) bool {
+			client := value.(*Client)
+			client.mu.Lock()
+			clientPath := roomPath + ".clients." + fmt.Sprint(clientIndex)
+			ctx.set(clientPath+".id", client.id)
+			ctx.set(clientPath+".rtt", client.rtt.Milliseconds())
+			ctx.setRaw(clientPath+".state", client.state)
+			ctx.println("  Client", fmt.Sprint(client.id), "(rtt", fmt.Sprint(client.rtt.Milliseconds())+"ms):", client.state)
+			client.mu.Unlock()
+			clientIndex++
+			return true
+		})
+
+		roomIndex++
+		return true
+	})
+	return nil
+}
+
+func runAudit(s *Server, ctx *CommandContext, args []string) error {
+	field, value, limit := "", "", 20
+	if len(args) >= 2 {
+		field, value = args[0], args[1]
+		args = args[2:]
+	}
+	if len(args) > 0 {
+		parsed, err := strconv.Atoi(args[0])
+		if err != nil {
+			return fmt.Errorf("count must be a number, got %q", args[0])
+		}
+		limit = parsed
+	}
+
+	entries, err := s.audit.query(field, value, limit)
+	if err != nil {
+		return fmt.Errorf("error reading audit log: %w", err)
+	}
+
+	ctx.setRaw("entries", "["+strings.Join(entries, ",")+"]")
+	for _, entry := range entries {
+		ctx.println(formatAuditEntry(entry))
+	}
+	return nil
+}
+
+func runStop(s *Server, ctx *CommandContext, args []string) error {
+	message := strings.Join(args, " ")
+	if message == "" {
+		message = "Server restarting. Check back in a bit!"
+	}
+
+	entry := AuditEntry{action: "stop", args: args, operator: ctx.operator}
+	s.onlineClients.Range(func(_, value interface{}) bool {
+		client := value.(*Client)
+		entry.clientIds = append(entry.clientIds, client.id)
+		go sendServerMessage(client, message)
+		return true
+	})
+	s.audit.record(entry)
+
+	ctx.println("Stopping server")
+	ctx.stop = true
+	return nil
+}
+
+// message, disable and kick take a selector followed by the message
+func targetedCommand(action string) func(s *Server, ctx *CommandContext, args []string) error {
+	return func(s *Server, ctx *CommandContext, args []string) error {
+		return sendToSelected(s, ctx, action, args[0], strings.Join(args[1:], " "), args)
+	}
+}
+
+// messageAll and disableAll take only the message
+func allCommand(action string) func(s *Server, ctx *CommandContext, args []string) error {
+	return func(s *Server, ctx *CommandContext, args []string) error {
+		return sendToSelected(s, ctx, action, "all", strings.Join(args, " "), args)
+	}
+}
+
+func sendToSelected(s *Server, ctx *CommandContext, action string, selector string, message string, args []string) error {
+	clients, err := s.selectClients(selector)
+	if err != nil {
+		return err
+	}
+	if len(clients) == 0 {
+		return fmt.Errorf("no online clients matched %s", selector)
+	}
+
+	entry := AuditEntry{action: action, args: args, operator: ctx.operator}
+	for _, client := range clients {
+		entry.clientIds = append(entry.clientIds, client.id)
+		if roomId := client.getRoom().id; !slices.Contains(entry.roomIds, roomId) {
+			entry.roomIds = append(entry.roomIds, roomId)
+		}
+
+		switch action {
+		case "message", "messageAll":
+			go sendServerMessage(client, message)
+		case "disable", "disableAll":
+			go sendDisable(client, message)
+		case "kick":
+			go sendKick(client, message)
+		}
+	}
+	s.audit.record(entry)
+
+	switch action {
+	case "message", "messageAll":
+		s.webhooks.emit(EVENT_ADMIN_BROADCAST, adminEventData(entry, message))
+	case "disable", "disableAll":
+		s.webhooks.emit(EVENT_ADMIN_DISABLE, adminEventData(entry, message))
+	}
+
+	ctx.set("clientIds", entry.clientIds)
+	ctx.printf("[Server] %s -> %s (%d clients)\n", action, selector, len(clients))
+	return nil
+}
+
+func runDeleteRoom(s *Server, ctx *CommandContext, args []string) error {
+	targetRoomID := args[0]
+
+	value, ok := s.rooms.Load(targetRoomID)
+	if !ok {
+		return fmt.Errorf("room %s not found", targetRoomID)
+	}
+
+	entry := AuditEntry{action: "deleteRoom", args: args, operator: ctx.operator, roomIds: []string{targetRoomID}}
+	s.onlineClients.Range(func(_, value interface{}) bool {
+		client := value.(*Client)
+		if client.getRoom().id == targetRoomID {
+			entry.clientIds = append(entry.clientIds, client.id)
+			go sendDisable(client, "Deleting your room. Goodbye!")
+		}
+		return true
+	})
+	s.removeRoom(value.(*Room))
+	s.audit.record(entry)
+	s.webhooks.emit(EVENT_ADMIN_DISABLE, adminEventData(entry, "Deleting your room. Goodbye!"))
+
+	ctx.set("clientIds", entry.clientIds)
+	ctx.printf("[Server] Deleted room %s (%d clients disabled)\n", targetRoomID, len(entry.clientIds))
+	return nil
+}
+
+func runBan(s *Server, ctx *CommandContext, args []string) error {
+	ban := &Ban{operator: ctx.operator.name}
+	if ip := net.ParseIP(args[0]); ip != nil {
+		ban.ip = ip.String()
+	} else {
+		clientId, err := strconv.ParseUint(args[0], 10, 64)
+		if err != nil || clientId == 0 {
+			return fmt.Errorf("%q is not a valid client id or IP", args[0])
+		}
+		ban.clientId = clientId
+
+		if value, ok := s.onlineClients.Load(clientId); ok {
+			// Also ban the address they are connected from, otherwise a fresh client id gets around it
+			client := value.(*Client)
+			client.mu.Lock()
+			if client.conn != nil {
+				ban.ip = remoteIP(client.conn)
+			}
+			client.mu.Unlock()
+		}
+	}
+
+	reasonStart := 1
+	if len(args) > 1 {
+		if duration, err := parseBanDuration(args[1]); err == nil {
+			ban.expires = time.Now().Add(duration)
+			reasonStart = 2
+		}
+	}
+	ban.reason = strings.Join(args[reasonStart:], " ")
+	s.bans.add(ban)
+
+	entry := AuditEntry{action: "ban", args: args, operator: ctx.operator}
+	s.onlineClients.Range(func(_, value interface{}) bool {
+		client := value.(*Client)
+		client.mu.Lock()
+		matches := client.id == ban.clientId || (ban.ip != "" && client.conn != nil && remoteIP(client.conn) == ban.ip)
+		client.mu.Unlock()
+		if matches {
+			entry.clientIds = append(entry.clientIds, client.id)
+			entry.roomIds = append(entry.roomIds, client.getRoom().id)
+			go sendDisable(client, ban.message())
+		}
+		return true
+	})
+	s.audit.record(entry)
+	if len(entry.clientIds) > 0 {
+		s.webhooks.emit(EVENT_ADMIN_DISABLE, adminEventData(entry, ban.message()))
+	}
+
+	ctx.set("banId", ban.id)
+	ctx.set("clientIds", entry.clientIds)
+	ctx.println("[Server]", ban)
+	return nil
+}
+
+func runReserve(s *Server, ctx *CommandContext, args []string) error {
+	roomId := args[0]
+	var password *string
+	if len(args) > 1 {
+		password = &args[1]
+		if args[1] == "-" {
+			password = new(string)
+		}
+	}
+
+	roomState := "{}"
+	if value, ok := s.rooms.Load(roomId); ok {
+		room := value.(*Room)
+		room.mu.Lock()
+		roomState, _ = sjson.Delete(room.state, "ownerClientId")
+		room.mu.Unlock()
+	}
+
+	existing := s.reserved.get(roomId) != nil
+	reserved := s.reserved.reserve(roomId, password, roomState, ctx.operator.name)
+	s.audit.record(AuditEntry{action: "reserve", args: redactCommand(append([]string{"reserve"}, args...))[1:], operator: ctx.operator, roomIds: []string{roomId}})
+
+	ctx.set("roomId", roomId)
+	ctx.set("passwordProtected", reserved.hasPassword())
+	if !existing {
+		ctx.println("[Server] Reserved room", roomId)
+	} else if password == nil {
+		ctx.println("[Server] Room", roomId, "is already reserved, its password is unchanged")
+	} else if *password == "" {
+		ctx.println("[Server] Removed the password of reserved room", roomId)
+	} else {
+		ctx.println("[Server] Updated the password of reserved room", roomId)
+	}
+	return nil
+}
+
+func runUnreserve(s *Server, ctx *CommandContext, args []string) error {
+	if !s.reserved.remove(args[0]) {
+		return fmt.Errorf("room %s is not reserved", args[0])
+	}
+
+	s.audit.record(AuditEntry{action: "unreserve", args: args, operator: ctx.operator, roomIds: []string{args[0]}})
+	ctx.println("[Server] Removed the reservation of room", args[0])
+	return nil
+}
+
+func runReserved(s *Server, ctx *CommandContext, _ []string) error {
+	ctx.data = "[]"
+	for i, reserved := range s.reserved.list() {
+		path := fmt.Sprint(i)
+		ctx.set(path+".roomId", reserved.roomId)
+		ctx.setRaw(path+".roomState", reserved.roomState)
+		ctx.set(path+".passwordProtected", reserved.hasPassword())
+		ctx.set(path+".operator", reserved.operator)
+		ctx.set(path+".created", reserved.created.UnixMilli())
+
+		_, live := s.rooms.Load(reserved.roomId)
+		ctx.printf("Room %s: password %t, live %t, reserved by %s on %s\n", reserved.roomId, reserved.hasPassword(),
+			live, reserved.operator, reserved.created.Format(time.DateTime))
+	}
+	return nil
+}
+
+func runRoomPreset(s *Server, ctx *CommandContext, args []string) error {
+	roomId := args[0]
+	// Joined back together since stdin splits on whitespace
+	roomState := strings.Join(args[1:], " ")
+	if !gjson.Valid(roomState) || !gjson.Parse(roomState).IsObject() {
+		return fmt.Errorf("room state must be a JSON object")
+	}
+	if !s.reserved.setState(roomId, roomState) {
+		return fmt.Errorf("room %s is not reserved", roomId)
+	}
+
+	if value, ok := s.rooms.Load(roomId); ok {
+		value.(*Room).replaceState(roomState)
+	}
+
+	s.audit.record(AuditEntry{action: "roomPreset", args: args, operator: ctx.operator, roomIds: []string{roomId}})
+	ctx.println("[Server] Set the preset state of room", roomId)
+	return nil
+}
+
+func runUnban(s *Server, ctx *CommandContext, args []string) error {
+	banId, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("%q is not a valid ban id", args[0])
+	}
+
+	ban := s.bans.remove(banId)
+	if ban == nil {
+		return fmt.Errorf("ban %d not found", banId)
+	}
+
+	entry := AuditEntry{action: "unban", args: args, operator: ctx.operator}
+	if ban.clientId != 0 {
+		entry.clientIds = []uint64{ban.clientId}
+	}
+	s.audit.record(entry)
+
+	ctx.println("[Server] Removed", ban)
+	return nil
+}
+
+func runBans(s *Server, ctx *CommandContext, _ []string) error {
+	ctx.data = "[]"
+	for i, ban := range s.bans.list() {
+		path := fmt.Sprint(i)
+		ctx.set(path+".id", ban.id)
+		ctx.set(path+".clientId", ban.clientId)
+		ctx.set(path+".ip", ban.ip)
+		ctx.set(path+".reason", ban.reason)
+		ctx.set(path+".operator", ban.operator)
+		if !ban.expires.IsZero() {
+			ctx.set(path+".expires", ban.expires.UnixMilli())
+		}
+		ctx.println(ban)
+	}
+	return nil
+}
+
+func runReloadFilter(s *Server, ctx *CommandContext, _ []string) error {
+	if err := s.loadFilter(); err != nil {
+		return fmt.Errorf("error loading word filter, keeping the previous one: %w", err)
+	}
+
+	s.audit.record(AuditEntry{action: "reloadFilter", operator: ctx.operator})
+	ctx.println("[Server] Word filter reloaded")
+	return nil
+}
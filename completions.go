@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+var COMPLETIONS_FILE = dataPath("completions.jsonl")
+
+const DEFAULT_LEADERBOARD_SIZE = 10
+const MAX_LEADERBOARD_SIZE = 100
+
+// Longest roomId, teamId, seed and settingsHash kept in a record
+const MAX_COMPLETION_FIELD_LENGTH = 64
+
+// One client finishing the game in one room, recorded once
+type Completion struct {
+	roomId       string
+	roomCreated  time.Time // Tells apart rooms that reused an id
+	teamId       string
+	clientId     uint64
+	members      []uint64 // Team members in the room at the time
+	game         string
+	elapsed      time.Duration // Since the room was created
+	seed         string
+	settingsHash string
+	completedAt  time.Time
+}
+
+// Append-only record of completions, also kept in memory to build leaderboards
+type CompletionLog struct {
+	path         string
+	records      []*Completion
+	seen         map[string]bool
+	lastByClient map[uint64]time.Time // Recent completions, for COMPLETION_COOLDOWN
+	mu           sync.Mutex           // Mutex for safely updating records
+}
+
+func NewCompletionLog(path string) *CompletionLog {
+	return &CompletionLog{path: path, seen: make(map[string]bool), lastByClient: make(map[uint64]time.Time)}
+}
+
+// Cuts client supplied strings down to MAX_COMPLETION_FIELD_LENGTH bytes,
+// dropping a rune split by the cut
+func truncateField(value string) string {
+	if len(value) <= MAX_COMPLETION_FIELD_LENGTH {
+		return value
+	}
+	return strings.ToValidUTF8(value[:MAX_COMPLETION_FIELD_LENGTH], "")
+}
+
+func (c *Completion) key() string {
+	return fmt.Sprintf("%s\x00%d\x00%d", c.roomId, c.roomCreated.UnixMilli(), c.clientId)
+}
+
+func (c *Completion) toJson() string {
+	value, _ := sjson.Set(`{}`, "roomId", c.roomId)
+	value, _ = sjson.Set(value, "roomCreated", c.roomCreated.UnixMilli())
+	value, _ = sjson.Set(value, "teamId", c.teamId)
+	value, _ = sjson.Set(value, "clientId", c.clientId)
+	value, _ = sjson.Set(value, "members", append([]uint64{}, c.members...))
+	value, _ = sjson.Set(value, "game", c.game)
+	value, _ = sjson.Set(value, "elapsedMs", c.elapsed.Milliseconds())
+	value, _ = sjson.Set(value, "seed", c.seed)
+	value, _ = sjson.Set(value, "settingsHash", c.settingsHash)
+	value, _ = sjson.Set(value, "completedAt", c.completedAt.UnixMilli())
+	return value
+}
+
+func completionFromJson(value gjson.Result) *Completion {
+	completion := &Completion{
+		roomId:       value.Get("roomId").String(),
+		roomCreated:  time.UnixMilli(value.Get("roomCreated").Int()),
+		teamId:       value.Get("teamId").String(),
+		clientId:     value.Get("clientId").Uint(),
+		game:         value.Get("game").String(),
+		elapsed:      time.Duration(value.Get("elapsedMs").Int()) * time.Millisecond,
+		seed:         value.Get("seed").String(),
+		settingsHash: value.Get("settingsHash").String(),
+		completedAt:  time.UnixMilli(value.Get("completedAt").Int()),
+	}
+	for _, member := range value.Get("members").Array() {
+		completion.members = append(completion.members, member.Uint())
+	}
+	return completion
+}
+
+func (l *CompletionLog) load() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	file, err := os.Open(l.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := scanner.Text()
+		if !gjson.Valid(line) {
+			log.Printf("Skipping invalid line %d of %s\n", lineNumber, l.path)
+			continue
+		}
+
+		completion := completionFromJson(gjson.Parse(line))
+		l.seen[completion.key()] = true
+		l.records = append(l.records, completion)
+	}
+
+	return scanner.Err()
+}
+
+// Stores the completion unless this client already completed in this room or
+// within COMPLETION_COOLDOWN of its last one, returns whether it was stored
+func (l *CompletionLog) record(completion *Completion) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.seen[completion.key()] {
+		return false
+	}
+	if last, ok := l.lastByClient[completion.clientId]; ok && completion.completedAt.Sub(last) < COMPLETION_COOLDOWN {
+		return false
+	}
+	for clientId, last := range l.lastByClient {
+		if completion.completedAt.Sub(last) >= COMPLETION_COOLDOWN {
+			delete(l.lastByClient, clientId)
+		}
+	}
+	if COMPLETION_COOLDOWN > 0 {
+		l.lastByClient[completion.clientId] = completion.completedAt
+	}
+	l.seen[completion.key()] = true
+	l.records = append(l.records, completion)
+
+	file, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Println("Error opening completions file:", err)
+		return true
+	}
+	defer file.Close()
+
+	if _, err := file.WriteString(completion.toJson() + "\n"); err != nil {
+		log.Println("Error writing completions file:", err)
+	}
+	return true
+}
+
+// Fastest completion of each team for a game, quickest first. A team's
+// members each record their own completion, only the earliest one counts.
+func (l *CompletionLog) leaderboard(game string, limit int) []*Completion {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	best := make(map[string]*Completion)
+	for _, completion := range l.records {
+		if completion.game != game {
+			continue
+		}
+
+		team := fmt.Sprintf("%s\x00%d\x00%s", completion.roomId, completion.roomCreated.UnixMilli(), completion.teamId)
+		if existing, ok := best[team]; !ok || completion.elapsed < existing.elapsed {
+			best[team] = completion
+		}
+	}
+
+	entries := make([]*Completion, 0, len(best))
+	for _, completion := range best {
+		entries = append(entries, completion)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].elapsed != entries[j].elapsed {
+			return entries[i].elapsed < entries[j].elapsed
+		}
+		return entries[i].completedAt.Before(entries[j].completedAt)
+	})
+
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries
+}
+
+func leaderboardJson(entries []*Completion) string {
+	value := `[]`
+	for i, entry := range entries {
+		path := fmt.Sprint(i)
+		value, _ = sjson.Set(value, path+".rank", i+1)
+		value, _ = sjson.Set(value, path+".roomId", entry.roomId)
+		value, _ = sjson.Set(value, path+".teamId", entry.teamId)
+		value, _ = sjson.Set(value, path+".members", append([]uint64{}, entry.members...))
+		value, _ = sjson.Set(value, path+".elapsedMs", entry.elapsed.Milliseconds())
+		value, _ = sjson.Set(value, path+".seed", entry.seed)
+		value, _ = sjson.Set(value, path+".settingsHash", entry.settingsHash)
+		value, _ = sjson.Set(value, path+".completedAt", entry.completedAt.UnixMilli())
+	}
+	return value
+}
+
+// Builds the completion record for a client's GAME_COMPLETE
+func (c *Client) newCompletion() *Completion {
+	c.mu.Lock()
+	team := c.team
+	game := c.game
+	c.mu.Unlock()
+
+	completion := &Completion{
+		roomId:      truncateField(c.room.id),
+		roomCreated: c.room.createdAt,
+		clientId:    c.id,
+		members:     []uint64{},
+		game:        game,
+		elapsed:     time.Since(c.room.createdAt),
+		completedAt: time.Now(),
+	}
+	if team != nil {
+		completion.teamId = truncateField(team.id)
+	}
+
+	c.room.mu.Lock()
+	completion.seed = truncateField(gjson.Get(c.room.state, "seed").String())
+	completion.settingsHash = truncateField(gjson.Get(c.room.state, "settingsHash").String())
+	c.room.mu.Unlock()
+
+	c.room.clients.Range(func(_, value interface{}) bool {
+		member := value.(*Client)
+		member.mu.Lock()
+		if member.team == team {
+			completion.members = append(completion.members, member.id)
+		}
+		member.mu.Unlock()
+		return true
+	})
+	sort.Slice(completion.members, func(i, j int) bool { return completion.members[i] < completion.members[j] })
+
+	return completion
+}
+
+// Clamps a requested leaderboard size, 0 meaning the default
+func leaderboardLimit(limit int) int {
+	if limit <= 0 {
+		return DEFAULT_LEADERBOARD_SIZE
+	}
+	return min(limit, MAX_LEADERBOARD_SIZE)
+}
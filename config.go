@@ -0,0 +1,92 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Directory holding the server's files: stats, history, bans, reservations,
+// archived rooms, completions, webhooks, the audit log and the control socket
+var DATA_DIR = envString("DATA_DIR", ".")
+
+// Tunables, overridable through environment variables of the same name
+var (
+	HANDSHAKE_TIMEOUT                  = envDuration("HANDSHAKE_TIMEOUT", 10*time.Second)
+	MAX_CONNECTIONS_PER_IP             = envInt("MAX_CONNECTIONS_PER_IP", 16)
+	MAX_CONNECTION_ATTEMPTS_PER_MINUTE = envInt("MAX_CONNECTION_ATTEMPTS_PER_MINUTE", 60)
+	MAX_MISSED_HEARTBEATS              = envInt("MAX_MISSED_HEARTBEATS", 3)
+	PING_INTERVAL                      = envDuration("PING_INTERVAL", 15*time.Second)
+	SHARE_CLIENT_RTT                   = envBool("SHARE_CLIENT_RTT", false)
+	CHAT_HISTORY_SIZE                  = envInt("CHAT_HISTORY_SIZE", 50)
+	MAX_ROOM_BYTES                     = envInt("MAX_ROOM_BYTES", 64<<20)
+	MAX_TOTAL_BYTES                    = envInt("MAX_TOTAL_BYTES", 1<<30)
+	OFFLINE_CLIENT_GRACE               = envDuration("OFFLINE_CLIENT_GRACE", 10*time.Minute)
+	ARCHIVE_RETENTION                  = envDuration("ARCHIVE_RETENTION", 7*24*time.Hour)
+	ROOM_IDLE_AFTER                    = envDuration("ROOM_IDLE_AFTER", 2*time.Minute)
+	ROOM_EXPIRY_WARNING                = envDuration("ROOM_EXPIRY_WARNING", time.Minute)
+	CONTROL_SOCKET                     = envString("CONTROL_SOCKET", dataPath("anchor.sock"))
+	STATS_FILE                         = envString("STATS_FILE", dataPath("stats.json"))
+	COMPLETION_COOLDOWN                = envDuration("COMPLETION_COOLDOWN", 10*time.Minute)
+	MAX_TRACKED_GAMES                  = envInt("MAX_TRACKED_GAMES", 64)
+)
+
+func dataPath(name string) string {
+	return filepath.Join(DATA_DIR, name)
+}
+
+func envString(name string, fallback string) string {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return fallback
+	}
+
+	return value
+}
+
+func envInt(name string, fallback int) int {
+	value, ok := os.LookupEnv(name)
+	if !ok || value == "" {
+		return fallback
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid value %q for %s, using %d\n", value, name, fallback)
+		return fallback
+	}
+
+	return parsed
+}
+
+func envBool(name string, fallback bool) bool {
+	value, ok := os.LookupEnv(name)
+	if !ok || value == "" {
+		return fallback
+	}
+
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid value %q for %s, using %t\n", value, name, fallback)
+		return fallback
+	}
+
+	return parsed
+}
+
+func envDuration(name string, fallback time.Duration) time.Duration {
+	value, ok := os.LookupEnv(name)
+	if !ok || value == "" {
+		return fallback
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid value %q for %s, using %v\n", value, name, fallback)
+		return fallback
+	}
+
+	return parsed
+}
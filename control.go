@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/user"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// Requests and replies on the control socket are null byte delimited JSON,
+// like the game protocol:
+//
+//	-> {"command":"list","args":[],"operator":"alice"}
+//	<- {"ok":true,"output":"Room ...","data":[...]}
+//	<- {"ok":false,"error":"unknown command \"lsit\", try help"}
+func (s *Server) listenControl() net.Listener {
+	if CONTROL_SOCKET == "" {
+		return nil
+	}
+
+	// A socket file left behind by a previous run would make Listen fail
+	if conn, err := net.Dial("unix", CONTROL_SOCKET); err == nil {
+		conn.Close()
+		log.Println("Control socket", CONTROL_SOCKET, "is in use by another server, not listening")
+		return nil
+	}
+	os.Remove(CONTROL_SOCKET)
+
+	listener, err := net.Listen("unix", CONTROL_SOCKET)
+	if err != nil {
+		log.Println("Error listening on control socket:", err)
+		return nil
+	}
+	os.Chmod(CONTROL_SOCKET, 0600)
+
+	log.Println("Control socket listening on", CONTROL_SOCKET)
+	return listener
+}
+
+func (s *Server) serveControl(listener net.Listener, errChan chan error) {
+	defer func() {
+		if r := recover(); r != nil {
+			errChan <- fmt.Errorf("panic in serveControl: %v", r)
+		}
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Println("Error accepting control connection:", err)
+			continue
+		}
+
+		go s.handleControlConnection(conn)
+	}
+}
+
+func (s *Server) handleControlConnection(conn net.Conn) {
+	defer conn.Close()
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Panic handling control command: %v", r)
+		}
+	}()
+
+	// The "operator" in a request is only what the caller claims to be, the
+	// audit log names the user the socket's peer credentials belong to
+	peer, ok := peerUser(conn)
+	if !ok {
+		peer = "unknown"
+	}
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, INITIAL_SCAN_BUFFER), MAX_PACKET_SIZE)
+	scanner.Split(splitNullByte)
+
+	for scanner.Scan() {
+		request := scanner.Text()
+		if !gjson.Valid(request) {
+			conn.Write(append([]byte(`{"ok":false,"error":"invalid JSON request"}`), 0))
+			continue
+		}
+
+		input := []string{}
+		if command := gjson.Get(request, "command").String(); command != "" {
+			input = append(input, command)
+		}
+		for _, arg := range gjson.Get(request, "args").Array() {
+			input = append(input, arg.String())
+		}
+		operator := Operator{name: peer, claimed: gjson.Get(request, "operator").String(), source: SOURCE_REMOTE}
+
+		log.Printf("[Control] %s ran %q\n", operator, redactCommand(input))
+		ctx, err := s.runCommand(operator, input)
+
+		reply := `{"ok":true}`
+		if err != nil {
+			reply, _ = sjson.Set(`{"ok":false}`, "error", err.Error())
+		}
+		reply, _ = sjson.Set(reply, "output", ctx.output.String())
+		reply, _ = sjson.SetRaw(reply, "data", ctx.data)
+		conn.Write(append([]byte(reply), 0))
+
+		if ctx.stop {
+			s.shutdown()
+		}
+	}
+}
+
+// Entry point for `anchor ctl [-json] <command> [args...]`, returns the exit code
+func runCtl(args []string) int {
+	asJson := false
+	if len(args) > 0 && (args[0] == "-json" || args[0] == "--json") {
+		asJson = true
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		args = []string{"help"}
+	}
+
+	conn, err := net.DialTimeout("unix", CONTROL_SOCKET, 5*time.Second)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not reach the server on", CONTROL_SOCKET+":", err)
+		return 1
+	}
+	defer conn.Close()
+
+	operator := "unknown"
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		operator = u.Username
+	}
+
+	request, _ := sjson.Set(`{}`, "command", args[0])
+	request, _ = sjson.Set(request, "args", args[1:])
+	request, _ = sjson.Set(request, "operator", operator)
+	if _, err := conn.Write(append([]byte(request), 0)); err != nil {
+		fmt.Fprintln(os.Stderr, "Error sending command:", err)
+		return 1
+	}
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, INITIAL_SCAN_BUFFER), MAX_PACKET_SIZE)
+	scanner.Split(splitNullByte)
+	if !scanner.Scan() {
+		fmt.Fprintln(os.Stderr, "No reply from the server:", scanner.Err())
+		return 1
+	}
+	reply := scanner.Text()
+
+	if asJson {
+		fmt.Println(reply)
+	} else {
+		fmt.Print(gjson.Get(reply, "output").String())
+		if !gjson.Get(reply, "ok").Bool() {
+			fmt.Fprintln(os.Stderr, "Error:", gjson.Get(reply, "error").String())
+		}
+	}
+
+	if !gjson.Get(reply, "ok").Bool() {
+		return 1
+	}
+	return 0
+}
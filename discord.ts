@@ -27,11 +27,14 @@ let stats = {
   pid: 0,
 };
 
+// Same path as the server's STATS_FILE, ./data/stats.json with the example compose file
+const statsFile = Bun.env.STATS_FILE || "./stats.json";
+
 async function refreshStats() {
   try {
-    stats = await Bun.file("./stats.json").json();
+    stats = await Bun.file(statsFile).json();
   } catch (error) {
-    console.error("An error occured while reading stats.json", error);
+    console.error(`An error occured while reading ${statsFile}`, error);
   }
 
   setTimeout(refreshStats, 1000 * 5);
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+var FILTER_FILE = dataPath("filter.json")
+
+const FILTER_REJECT_MESSAGE = "That contains language that isn't allowed on this server."
+
+// Example filter.json:
+//
+//	{
+//	  "clientStateFields": ["name"],
+//	  "chatFields": ["message"],
+//	  "rules": [
+//	    {"words": ["badword", "worseword"], "action": "mask"},
+//	    {"pattern": "(?i)b[a@4]dw[o0]rd", "action": "reject"}
+//	  ]
+//	}
+type WordFilter struct {
+	clientStateFields []string // Paths inside clientState that are checked
+	chatFields        []string // Paths inside CHAT_MESSAGE packets that are checked
+	rules             []filterRule
+}
+
+type filterRule struct {
+	re     *regexp.Regexp
+	reject bool // Refuse the packet instead of masking the match
+	source string
+}
+
+type FilterResult struct {
+	packet   string
+	rejected bool
+	hits     []string // Source of every rule that matched
+}
+
+func loadWordFilter(path string) (*WordFilter, error) {
+	filter := &WordFilter{}
+
+	value, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return filter, nil
+		}
+		return nil, err
+	}
+	if !gjson.ValidBytes(value) {
+		return nil, fmt.Errorf("%s is not valid JSON", path)
+	}
+
+	config := gjson.ParseBytes(value)
+	for _, field := range config.Get("clientStateFields").Array() {
+		filter.clientStateFields = append(filter.clientStateFields, field.String())
+	}
+	for _, field := range config.Get("chatFields").Array() {
+		filter.chatFields = append(filter.chatFields, field.String())
+	}
+
+	for i, rule := range config.Get("rules").Array() {
+		action := rule.Get("action").String()
+		if action != "mask" && action != "reject" {
+			return nil, fmt.Errorf("rule %d: action must be mask or reject, got %q", i, action)
+		}
+
+		var pattern string
+		var source string
+		if words := rule.Get("words"); words.Exists() {
+			quoted := []string{}
+			for _, word := range words.Array() {
+				quoted = append(quoted, regexp.QuoteMeta(word.String()))
+			}
+			if len(quoted) == 0 {
+				continue
+			}
+			pattern = `(?i)\b(?:` + strings.Join(quoted, "|") + `)\b`
+			source = fmt.Sprintf("rule %d words", i)
+		} else {
+			pattern = rule.Get("pattern").String()
+			source = fmt.Sprintf("rule %d pattern %s", i, pattern)
+		}
+
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+
+		filter.rules = append(filter.rules, filterRule{re: re, reject: action == "reject", source: source})
+	}
+
+	return filter, nil
+}
+
+func (f *WordFilter) filterText(text string) (string, bool, []string) {
+	hits := []string{}
+	for _, rule := range f.rules {
+		if !rule.re.MatchString(text) {
+			continue
+		}
+
+		hits = append(hits, rule.source)
+		if rule.reject {
+			return text, true, hits
+		}
+		text = rule.re.ReplaceAllStringFunc(text, func(match string) string {
+			return strings.Repeat("*", len([]rune(match)))
+		})
+	}
+
+	return text, false, hits
+}
+
+// Checks the string values at prefix+field for every field, masking them in
+// the returned packet or flagging the whole packet as rejected
+func (f *WordFilter) filterPacket(packet string, prefix string, fields []string) FilterResult {
+	result := FilterResult{packet: packet, hits: []string{}}
+
+	for _, field := range fields {
+		path := prefix + field
+		value := gjson.Get(result.packet, path)
+		if value.Type != gjson.String {
+			continue
+		}
+
+		text, rejected, hits := f.filterText(value.String())
+		result.hits = append(result.hits, hits...)
+		if rejected {
+			result.rejected = true
+			return result
+		}
+		if text != value.String() {
+			result.packet, _ = sjson.Set(result.packet, path, text)
+		}
+	}
+
+	return result
+}
+
+func (r *FilterResult) log(from string) {
+	if len(r.hits) == 0 {
+		return
+	}
+
+	action := "masked"
+	if r.rejected {
+		action = "rejected"
+	}
+	log.Printf("Filter %s packet from %s, matched %s\n", action, from, strings.Join(r.hits, ", "))
+}
+
+func (f *WordFilter) filterClientState(packet string, prefix string) FilterResult {
+	return f.filterPacket(packet, prefix, f.clientStateFields)
+}
+
+func (f *WordFilter) filterChat(packet string) FilterResult {
+	return f.filterPacket(packet, "", f.chatFields)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+const UNKNOWN_GAME = "unknown"
+const MAX_GAME_NAME_LENGTH = 64
+
+// Lifetime counters for one game, persisted in stats.json
+type GameCounts struct {
+	uniqueCount       uint64
+	gameCompleteCount uint64
+}
+
+type GameStats struct {
+	counts map[string]*GameCounts
+	mu     sync.Mutex // Mutex for safely updating counts
+}
+
+func NewGameStats() *GameStats {
+	return &GameStats{counts: make(map[string]*GameCounts)}
+}
+
+// Clients name the game they are running as "game" in their state, falling
+// back to the room's "game" setting for clients that don't. Names over
+// MAX_GAME_NAME_LENGTH count as unknown.
+func gameFromState(clientState string, roomState string) string {
+	game := gjson.Get(clientState, "game").String()
+	if game == "" {
+		game = gjson.Get(roomState, "game").String()
+	}
+	if game == "" || len(game) > MAX_GAME_NAME_LENGTH {
+		return UNKNOWN_GAME
+	}
+	return game
+}
+
+// Returns the name a game is counted under. Once MAX_TRACKED_GAMES games are
+// tracked, new ones count as unknown so clients can't grow stats.json.
+func (g *GameStats) track(game string) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.nameLocked(game)
+}
+
+func (g *GameStats) nameLocked(game string) string {
+	if _, ok := g.counts[game]; ok || game == UNKNOWN_GAME {
+		return game
+	}
+	if len(game) > MAX_GAME_NAME_LENGTH || (MAX_TRACKED_GAMES > 0 && len(g.counts) >= MAX_TRACKED_GAMES) {
+		return UNKNOWN_GAME
+	}
+	g.counts[game] = &GameCounts{}
+	return game
+}
+
+func (g *GameStats) getLocked(game string) *GameCounts {
+	game = g.nameLocked(game)
+	counts, ok := g.counts[game]
+	if !ok {
+		counts = &GameCounts{}
+		g.counts[game] = counts
+	}
+	return counts
+}
+
+func (g *GameStats) addUnique(game string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.getLocked(game).uniqueCount++
+}
+
+func (g *GameStats) addGameComplete(game string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.getLocked(game).gameCompleteCount++
+}
+
+// Restores the lifetime counters from a stats.json "games" object
+func (g *GameStats) load(games gjson.Result) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// Games past the limits are folded into unknown
+	games.ForEach(func(game, value gjson.Result) bool {
+		counts := g.getLocked(game.String())
+		counts.uniqueCount += value.Get("uniqueCount").Uint()
+		counts.gameCompleteCount += value.Get("gameCompleteCount").Uint()
+		return true
+	})
+}
+
+// Builds a "games" object keyed by game, with the online count for each
+// alongside the lifetime counters
+func (s *Server) gameStatsJson() string {
+	online := make(map[string]int)
+	s.onlineClients.Range(func(_, value interface{}) bool {
+		client := value.(*Client)
+		client.mu.Lock()
+		online[client.game]++
+		client.mu.Unlock()
+		return true
+	})
+
+	s.games.mu.Lock()
+	defer s.games.mu.Unlock()
+
+	for game, count := range online {
+		if name := s.games.nameLocked(game); name != game {
+			delete(online, game)
+			online[name] += count
+		}
+	}
+	games := make([]string, 0, len(s.games.counts))
+	for game := range s.games.counts {
+		games = append(games, game)
+	}
+	sort.Strings(games)
+
+	value := `{}`
+	for _, game := range games {
+		path := gjson.Escape(game)
+		value, _ = sjson.Set(value, path+".onlineCount", online[game])
+		value, _ = sjson.Set(value, path+".uniqueCount", s.games.counts[game].uniqueCount)
+		value, _ = sjson.Set(value, path+".gameCompleteCount", s.games.counts[game].gameCompleteCount)
+	}
+	return value
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+var HISTORY_DIR = dataPath("history")
+
+const HISTORY_SAMPLE_INTERVAL = 10 * time.Second
+
+var HISTORY_RESOLUTIONS = map[string]time.Duration{
+	"minute": time.Minute,
+	"hour":   time.Hour,
+	"day":    24 * time.Hour,
+}
+
+// How long buckets are kept at each resolution, 0 keeps them forever. Older
+// minutes and hours are still covered by the coarser resolutions.
+var HISTORY_RETENTION = map[string]time.Duration{
+	"minute": 48 * time.Hour,
+	"hour":   90 * 24 * time.Hour,
+	"day":    0,
+}
+
+// Aggregate of the samples taken within one period at one resolution
+type HistoryBucket struct {
+	start         time.Time
+	samples       int
+	onlineSum     int
+	peakOnline    int
+	roomSum       int
+	peakRooms     int
+	newUnique     uint64
+	gameCompletes uint64
+}
+
+// Rolling aggregates written to one append-only file per resolution. A bucket
+// is appended once its period ends, or early on shutdown, so the same period
+// can appear more than once and is merged back together when queried. Every
+// hour the files are rewritten with duplicates merged and buckets past
+// HISTORY_RETENTION dropped.
+type StatsHistory struct {
+	dir           string
+	current       map[string]*HistoryBucket
+	lastUnique    uint64
+	lastCompletes uint64
+	primed        bool       // Counters above hold a baseline
+	mu            sync.Mutex // Mutex for safely updating buckets
+}
+
+func NewStatsHistory(dir string) *StatsHistory {
+	return &StatsHistory{dir: dir, current: make(map[string]*HistoryBucket)}
+}
+
+func (s *Server) recordHistory(errChan chan error) {
+	ticker := time.NewTicker(HISTORY_SAMPLE_INTERVAL)
+	defer ticker.Stop()
+	defer func() {
+		if r := recover(); r != nil {
+			errChan <- fmt.Errorf("panic in recordHistory: %v", r)
+		}
+	}()
+
+	for now := range ticker.C {
+		s.history.sample(now, s.onlineCount(), s.roomCount(), s.nextClientId.Load(), s.gameCompleteCount.Load())
+	}
+}
+
+func (h *StatsHistory) sample(now time.Time, online int, rooms int, unique uint64, completes uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var newUnique, newCompletes uint64
+	if h.primed {
+		if unique > h.lastUnique {
+			newUnique = unique - h.lastUnique
+		}
+		if completes > h.lastCompletes {
+			newCompletes = completes - h.lastCompletes
+		}
+	}
+	h.lastUnique, h.lastCompletes, h.primed = unique, completes, true
+
+	for resolution, period := range HISTORY_RESOLUTIONS {
+		start := now.UTC().Truncate(period)
+		bucket := h.current[resolution]
+		if bucket != nil && !bucket.start.Equal(start) {
+			h.appendLocked(resolution, bucket)
+			if resolution == "hour" {
+				h.trimLocked(now)
+			}
+			bucket = nil
+		}
+		if bucket == nil {
+			bucket = &HistoryBucket{start: start}
+			h.current[resolution] = bucket
+		}
+
+		bucket.samples++
+		bucket.onlineSum += online
+		bucket.peakOnline = max(bucket.peakOnline, online)
+		bucket.roomSum += rooms
+		bucket.peakRooms = max(bucket.peakRooms, rooms)
+		bucket.newUnique += newUnique
+		bucket.gameCompletes += newCompletes
+	}
+}
+
+// Writes out the partially filled buckets, used on shutdown
+func (h *StatsHistory) flush() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for resolution, bucket := range h.current {
+		h.appendLocked(resolution, bucket)
+	}
+	h.current = make(map[string]*HistoryBucket)
+}
+
+func (h *StatsHistory) appendLocked(resolution string, bucket *HistoryBucket) {
+	if bucket.samples == 0 {
+		return
+	}
+
+	line := bucket.toJson()
+
+	if err := os.MkdirAll(h.dir, 0755); err != nil {
+		log.Println("Error creating history directory:", err)
+		return
+	}
+
+	file, err := os.OpenFile(filepath.Join(h.dir, resolution+".jsonl"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Println("Error opening history file:", err)
+		return
+	}
+	defer file.Close()
+
+	if _, err := file.WriteString(line + "\n"); err != nil {
+		log.Println("Error writing history file:", err)
+	}
+}
+
+// Returns the last limit buckets at the given resolution, oldest first,
+// including the one currently being filled
+func (h *StatsHistory) query(resolution string, limit int) ([]*HistoryBucket, error) {
+	if _, ok := HISTORY_RESOLUTIONS[resolution]; !ok {
+		return nil, fmt.Errorf("unknown resolution %q, expected minute, hour or day", resolution)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	buckets, err := h.readLocked(resolution)
+	if err != nil {
+		return nil, err
+	}
+	if bucket, ok := h.current[resolution]; ok {
+		buckets = mergeBuckets(append(buckets, bucket))
+	}
+
+	if limit > 0 && len(buckets) > limit {
+		buckets = buckets[len(buckets)-limit:]
+	}
+	return buckets, nil
+}
+
+// Reads the buckets written at a resolution, merged and oldest first
+func (h *StatsHistory) readLocked(resolution string) ([]*HistoryBucket, error) {
+	file, err := os.Open(filepath.Join(h.dir, resolution+".jsonl"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	buckets := []*HistoryBucket{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !gjson.Valid(line) {
+			continue
+		}
+		buckets = append(buckets, &HistoryBucket{
+			start:         time.UnixMilli(gjson.Get(line, "start").Int()).UTC(),
+			samples:       int(gjson.Get(line, "samples").Int()),
+			onlineSum:     int(gjson.Get(line, "onlineSum").Int()),
+			peakOnline:    int(gjson.Get(line, "peakOnline").Int()),
+			roomSum:       int(gjson.Get(line, "roomSum").Int()),
+			peakRooms:     int(gjson.Get(line, "peakRooms").Int()),
+			newUnique:     gjson.Get(line, "newUnique").Uint(),
+			gameCompletes: gjson.Get(line, "gameCompletes").Uint(),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return mergeBuckets(buckets), nil
+}
+
+// Rewrites each history file with duplicate periods merged and buckets older
+// than the resolution's retention dropped
+func (h *StatsHistory) trimLocked(now time.Time) {
+	for resolution := range HISTORY_RESOLUTIONS {
+		buckets, err := h.readLocked(resolution)
+		if err != nil {
+			log.Println("Error reading history file:", err)
+			continue
+		}
+		if len(buckets) == 0 {
+			continue
+		}
+
+		var value []byte
+		for _, bucket := range buckets {
+			if retention := HISTORY_RETENTION[resolution]; retention > 0 && now.Sub(bucket.start) > retention {
+				continue
+			}
+			value = append(value, bucket.toJson()+"\n"...)
+		}
+
+		if err := writeFileAtomic(filepath.Join(h.dir, resolution+".jsonl"), value); err != nil {
+			log.Println("Error trimming history file:", err)
+		}
+	}
+}
+
+// Combines buckets covering the same period, returned oldest first
+func mergeBuckets(buckets []*HistoryBucket) []*HistoryBucket {
+	byStart := make(map[int64]*HistoryBucket)
+	merged := []*HistoryBucket{}
+	for _, bucket := range buckets {
+		existing, ok := byStart[bucket.start.UnixMilli()]
+		if !ok {
+			copied := *bucket
+			byStart[bucket.start.UnixMilli()] = &copied
+			merged = append(merged, &copied)
+			continue
+		}
+		existing.samples += bucket.samples
+		existing.onlineSum += bucket.onlineSum
+		existing.peakOnline = max(existing.peakOnline, bucket.peakOnline)
+		existing.roomSum += bucket.roomSum
+		existing.peakRooms = max(existing.peakRooms, bucket.peakRooms)
+		existing.newUnique += bucket.newUnique
+		existing.gameCompletes += bucket.gameCompletes
+	}
+
+	sort.Slice(merged, func(i, j int) bool { return merged[i].start.Before(merged[j].start) })
+	return merged
+}
+
+func (b *HistoryBucket) toJson() string {
+	value, _ := sjson.Set(`{}`, "start", b.start.UnixMilli())
+	value, _ = sjson.Set(value, "samples", b.samples)
+	value, _ = sjson.Set(value, "peakOnline", b.peakOnline)
+	value, _ = sjson.Set(value, "onlineSum", b.onlineSum)
+	value, _ = sjson.Set(value, "peakRooms", b.peakRooms)
+	value, _ = sjson.Set(value, "roomSum", b.roomSum)
+	value, _ = sjson.Set(value, "newUnique", b.newUnique)
+	value, _ = sjson.Set(value, "gameCompletes", b.gameCompletes)
+	return value
+}
+
+func (b *HistoryBucket) averageOnline() float64 {
+	if b.samples == 0 {
+		return 0
+	}
+	return float64(b.onlineSum) / float64(b.samples)
+}
+
+func (b *HistoryBucket) averageRooms() float64 {
+	if b.samples == 0 {
+		return 0
+	}
+	return float64(b.roomSum) / float64(b.samples)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/tidwall/sjson"
+)
+
+// Room lifecycle, reevaluated every HEARTBEAT by cleanupInactiveRooms:
+//
+//	active    someone is connected and the room saw activity within ROOM_IDLE_AFTER
+//	idle      someone is connected but nobody has done anything for ROOM_IDLE_AFTER
+//	empty     nobody is connected
+//	expiring  nobody is connected and the room closes within ROOM_EXPIRY_WARNING
+//
+// A room is only deleted once nobody has been connected for
+// INACTIVITY_TIMEOUT, and reserved rooms never are. Deciding that and closing
+// the room happen under its mutex, so a client joining at the same time
+// either makes it in first and keeps the room alive, or finds it closed and
+// joins its replacement. Disconnected members can't be warned, so members of
+// a room turning idle are told how long it outlives them instead.
+const (
+	ROOM_ACTIVE   = "active"
+	ROOM_IDLE     = "idle"
+	ROOM_EMPTY    = "empty"
+	ROOM_EXPIRING = "expiring"
+)
+
+const ROOM_IDLE_MESSAGE = "Nobody has done anything in this room for a while. Once everyone has left, it will be deleted after %v."
+
+func (r *Room) connectedCount() int {
+	count := 0
+	r.clients.Range(func(_, value interface{}) bool {
+		client := value.(*Client)
+		client.mu.Lock()
+		if client.conn != nil {
+			count++
+		}
+		client.mu.Unlock()
+		return true
+	})
+	return count
+}
+
+func (r *Room) getLifecycle() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lifecycle
+}
+
+// Moves the room to its current lifecycle state, telling connected members
+// about any change. Returns true once the room has expired, in which case it
+// is closed and must be removed. Reserved rooms never expire.
+func (r *Room) updateLifecycle(now time.Time, reserved bool) bool {
+	r.mu.Lock()
+	connected := r.connectedCount()
+	lastActivity := r.GetLastActivity()
+
+	if connected == 0 && r.emptySince.IsZero() {
+		r.emptySince = now
+	} else if connected > 0 {
+		r.emptySince = time.Time{}
+	}
+
+	state := ROOM_ACTIVE
+	if connected == 0 {
+		// Leaving counts as activity, so the last member to disconnect from an
+		// idle room doesn't find it gone straight away
+		quietSince := lastActivity
+		if r.emptySince.After(quietSince) {
+			quietSince = r.emptySince
+		}
+		expiresAt := quietSince.Add(INACTIVITY_TIMEOUT)
+		if !reserved && !now.Before(expiresAt) {
+			r.closed = true
+			r.mu.Unlock()
+			return true
+		}
+
+		state = ROOM_EMPTY
+		if !reserved && expiresAt.Sub(now) <= ROOM_EXPIRY_WARNING {
+			state = ROOM_EXPIRING
+		}
+	} else if now.Sub(lastActivity) >= ROOM_IDLE_AFTER {
+		state = ROOM_IDLE
+	}
+
+	changed := state != r.lifecycle
+	r.lifecycle = state
+	r.mu.Unlock()
+
+	if !changed || connected == 0 {
+		return false
+	}
+
+	warn := state == ROOM_IDLE && !reserved
+	packet, _ := sjson.Set(`{"type":"ROOM_LIFECYCLE"}`, "state", state)
+	if warn {
+		packet, _ = sjson.Set(packet, "expiresAfterLeavingMs", INACTIVITY_TIMEOUT.Milliseconds())
+	}
+	r.broadcastPacket(packet)
+
+	if warn {
+		message, _ := sjson.Set(`{"type":"SERVER_MESSAGE"}`, "message", fmt.Sprintf(ROOM_IDLE_MESSAGE, INACTIVITY_TIMEOUT))
+		r.broadcastPacket(message)
+	}
+	return false
+}
+
+// Runs add with the room locked so it can't be closed meanwhile, add must not
+// take the room's mutex. Returns false without running add if the room is
+// already closed.
+func (r *Room) enter(add func()) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return false
+	}
+	add()
+	return true
+}
+
+// Waits until a closed room is gone from the server, so the next lookup
+// creates its replacement, restored from the archive if it was written
+func (s *Server) awaitRemoval(room *Room) {
+	for {
+		if value, ok := s.rooms.Load(room.id); !ok || value.(*Room) != room {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
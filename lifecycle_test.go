@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestUpdateLifecycle(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name         string
+		connected    bool
+		lastActivity time.Duration // Before now
+		emptyFor     time.Duration // Before now, zero if nobody has left yet
+		reserved     bool
+		want         string
+		wantExpired  bool
+	}{
+		{name: "connected and active", connected: true, lastActivity: time.Second, want: ROOM_ACTIVE},
+		{name: "connected and quiet", connected: true, lastActivity: ROOM_IDLE_AFTER, want: ROOM_IDLE},
+		{name: "connected past the timeout is kept", connected: true, lastActivity: 2 * INACTIVITY_TIMEOUT, want: ROOM_IDLE},
+		{name: "just emptied", lastActivity: time.Hour, want: ROOM_EMPTY},
+		{name: "empty for a while", lastActivity: time.Hour, emptyFor: INACTIVITY_TIMEOUT - ROOM_EXPIRY_WARNING - time.Second, want: ROOM_EMPTY},
+		{name: "about to expire", lastActivity: time.Hour, emptyFor: INACTIVITY_TIMEOUT - ROOM_EXPIRY_WARNING, want: ROOM_EXPIRING},
+		{name: "expired", lastActivity: time.Hour, emptyFor: INACTIVITY_TIMEOUT, wantExpired: true},
+		{name: "reserved and quiet", connected: true, lastActivity: ROOM_IDLE_AFTER, reserved: true, want: ROOM_IDLE},
+		{name: "reserved and empty never expires", lastActivity: time.Hour, emptyFor: INACTIVITY_TIMEOUT, reserved: true, want: ROOM_EMPTY},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			room := newTestRoom(t)
+			client := addTestClient(t, room, 1, room.findOrCreateTeam(""), test.connected)
+			client.lastActivity = now.Add(-test.lastActivity)
+			if test.emptyFor > 0 {
+				room.emptySince = now.Add(-test.emptyFor)
+			}
+
+			expired := room.updateLifecycle(now, test.reserved)
+			if expired != test.wantExpired {
+				t.Fatalf("updateLifecycle returned %t, want %t", expired, test.wantExpired)
+			}
+			if room.closed != test.wantExpired {
+				t.Errorf("room closed = %t, want %t", room.closed, test.wantExpired)
+			}
+			if !test.wantExpired && room.getLifecycle() != test.want {
+				t.Errorf("got state %s, want %s", room.getLifecycle(), test.want)
+			}
+		})
+	}
+}
+
+func TestEnterClosedRoom(t *testing.T) {
+	now := time.Now()
+	room := newTestRoom(t)
+	room.emptySince = now.Add(-INACTIVITY_TIMEOUT)
+	if !room.updateLifecycle(now, false) {
+		t.Fatal("an empty room past the timeout should expire")
+	}
+
+	if room.enter(func() { t.Error("joined a closed room") }) {
+		t.Error("enter succeeded on a closed room")
+	}
+}
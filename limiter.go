@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Caps concurrent connections and connection attempts per remote IP. Attempts
+// are counted in fixed one minute windows.
+type ConnectionLimiter struct {
+	active      map[string]int
+	attempts    map[string]int
+	windowStart time.Time
+	mu          sync.Mutex // Mutex for safely updating counters
+}
+
+func NewConnectionLimiter() *ConnectionLimiter {
+	return &ConnectionLimiter{
+		active:      make(map[string]int),
+		attempts:    make(map[string]int),
+		windowStart: time.Now(),
+	}
+}
+
+func (l *ConnectionLimiter) acquire(ip string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if time.Since(l.windowStart) > time.Minute {
+		l.attempts = make(map[string]int)
+		l.windowStart = time.Now()
+	}
+
+	l.attempts[ip]++
+	if MAX_CONNECTION_ATTEMPTS_PER_MINUTE > 0 && l.attempts[ip] > MAX_CONNECTION_ATTEMPTS_PER_MINUTE {
+		return fmt.Errorf("over %d connection attempts this minute", MAX_CONNECTION_ATTEMPTS_PER_MINUTE)
+	}
+
+	if MAX_CONNECTIONS_PER_IP > 0 && l.active[ip] >= MAX_CONNECTIONS_PER_IP {
+		return fmt.Errorf("already has %d open connections", l.active[ip])
+	}
+
+	l.active[ip]++
+	return nil
+}
+
+func (l *ConnectionLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.active[ip]--
+	if l.active[ip] <= 0 {
+		delete(l.active, ip)
+	}
+}
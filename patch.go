@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// Applies a JSON merge patch (RFC 7386) to an object: null deletes a key,
+// objects are merged recursively and anything else replaces the value
+func applyMergePatch(doc string, patch gjson.Result) (string, error) {
+	if !patch.IsObject() {
+		return "", errors.New("merge patch must be an object")
+	}
+	if !gjson.Parse(doc).IsObject() {
+		doc = "{}"
+	}
+
+	var err error
+	patch.ForEach(func(key, value gjson.Result) bool {
+		path := gjson.Escape(key.String())
+		switch {
+		case value.Type == gjson.Null:
+			doc, err = sjson.Delete(doc, path)
+		case value.IsObject():
+			var merged string
+			if merged, err = applyMergePatch(gjson.Get(doc, path).Raw, value); err == nil {
+				doc, err = sjson.SetRaw(doc, path, merged)
+			}
+		default:
+			doc, err = sjson.SetRaw(doc, path, value.Raw)
+		}
+		return err == nil
+	})
+
+	return doc, err
+}
+
+// Applies path operations in order, all or nothing:
+//
+//	[{"op":"set","path":"flags.3","value":true},{"op":"delete","path":"items.bow"}]
+//
+// Paths use gjson/sjson syntax, keys containing dots are escaped with a backslash.
+func applyPathOps(doc string, ops gjson.Result) (string, error) {
+	if !ops.IsArray() {
+		return "", errors.New("ops must be an array")
+	}
+
+	for i, op := range ops.Array() {
+		path := op.Get("path").String()
+		if path == "" {
+			return "", fmt.Errorf("op %d has no path", i)
+		}
+
+		var err error
+		switch op.Get("op").String() {
+		case "set":
+			value := op.Get("value")
+			if !value.Exists() {
+				return "", fmt.Errorf("op %d has no value", i)
+			}
+			doc, err = sjson.SetRaw(doc, path, value.Raw)
+		case "delete":
+			doc, err = sjson.Delete(doc, path)
+		default:
+			return "", fmt.Errorf("op %d has unknown op %q, expected set or delete", i, op.Get("op").String())
+		}
+		if err != nil {
+			return "", fmt.Errorf("op %d: %w", i, err)
+		}
+	}
+
+	return doc, nil
+}
+
+// Applies whichever of "mergePatch" or "ops" a patch packet carries
+func applyPatchPacket(doc string, packet string) (string, error) {
+	if mergePatch := gjson.Get(packet, "mergePatch"); mergePatch.Exists() {
+		return applyMergePatch(doc, mergePatch)
+	}
+	if ops := gjson.Get(packet, "ops"); ops.Exists() {
+		return applyPathOps(doc, ops)
+	}
+	return "", errors.New("patch has neither mergePatch nor ops")
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/tidwall/gjson"
+)
+
+func TestApplyPatchPacket(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     string
+		packet  string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "merge patch sets and deletes keys",
+			doc:    `{"a":1,"b":2}`,
+			packet: `{"mergePatch":{"a":3,"b":null,"c":true}}`,
+			want:   `{"a":3,"c":true}`,
+		},
+		{
+			name:   "merge patch merges nested objects",
+			doc:    `{"logic":{"bridge":"vanilla","songs":false}}`,
+			packet: `{"mergePatch":{"logic":{"songs":true}}}`,
+			want:   `{"logic":{"bridge":"vanilla","songs":true}}`,
+		},
+		{
+			name:   "merge patch replaces non-objects with objects",
+			doc:    `{"a":1}`,
+			packet: `{"mergePatch":{"a":{"b":1}}}`,
+			want:   `{"a":{"b":1}}`,
+		},
+		{
+			name:   "merge patch escapes dotted keys",
+			doc:    `{}`,
+			packet: `{"mergePatch":{"a.b":1}}`,
+			want:   `{"a.b":1}`,
+		},
+		{
+			name:    "merge patch must be an object",
+			doc:     `{}`,
+			packet:  `{"mergePatch":[1]}`,
+			wantErr: true,
+		},
+		{
+			name:   "ops apply in order",
+			doc:    `{"flags":[0,0],"items":{"bow":true}}`,
+			packet: `{"ops":[{"op":"set","path":"flags.1","value":5},{"op":"delete","path":"items.bow"},{"op":"set","path":"items.hookshot","value":1}]}`,
+			want:   `{"flags":[0,5],"items":{"hookshot":1}}`,
+		},
+		{
+			name:    "ops without a path are rejected",
+			doc:     `{}`,
+			packet:  `{"ops":[{"op":"set","value":1}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "set without a value is rejected",
+			doc:     `{}`,
+			packet:  `{"ops":[{"op":"set","path":"a"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "unknown ops are rejected",
+			doc:     `{}`,
+			packet:  `{"ops":[{"op":"move","path":"a"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "ops must be an array",
+			doc:     `{}`,
+			packet:  `{"ops":{"op":"set"}}`,
+			wantErr: true,
+		},
+		{
+			name:    "packet needs a patch",
+			doc:     `{}`,
+			packet:  `{"type":"PATCH_TEAM_STATE"}`,
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := applyPatchPacket(test.doc, test.packet)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !jsonEqual(got, test.want) {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+// Compares JSON ignoring key order and whitespace
+func jsonEqual(a string, b string) bool {
+	return gjson.Parse(a).Get("@pretty:{\"sortKeys\":true}").Raw == gjson.Parse(b).Get("@pretty:{\"sortKeys\":true}").Raw
+}
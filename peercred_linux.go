@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// Names the local user on the other end of a control connection from the
+// kernel's peer credentials, which the caller can't forge
+func peerUser(conn net.Conn) (string, bool) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return "", false
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return "", false
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil || credErr != nil {
+		return "", false
+	}
+
+	uid := strconv.FormatUint(uint64(cred.Uid), 10)
+	if u, err := user.LookupId(uid); err == nil && u.Username != "" {
+		return u.Username, true
+	}
+	return "uid " + uid, true
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "net"
+
+// Peer credentials are only read on Linux, elsewhere the caller is unknown
+func peerUser(conn net.Conn) (string, bool) {
+	return "", false
+}
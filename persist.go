@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+)
+
+// Writes data to a temporary file next to path and renames it into place, so
+// a reader never sees a half written file and a crash leaves the old one
+func writeFileAtomic(path string, data []byte) error {
+	return writeFileAtomicMode(path, data, 0644)
+}
+
+// Like writeFileAtomic, for files that only the server's user should read
+func writeFileAtomicMode(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	os.Remove(tmp) // OpenFile keeps the mode of a leftover file
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
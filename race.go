@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+const DEFAULT_RACE_COUNTDOWN = 10 * time.Second
+const MAX_RACE_COUNTDOWN = time.Minute
+
+// A team's first GAME_COMPLETE after the race started
+type RaceFinish struct {
+	teamId   string
+	clientId uint64
+	elapsed  time.Duration
+}
+
+// Race mode for a room, started by the owner with START_RACE:
+//
+//	-> {"type":"START_RACE","countdownMs":10000}
+//	<- {"type":"RACE_START","raceId":1,"startAt":<server ms>,"countdownMs":10000,"serverTime":<server ms>}
+//	<- {"type":"RACE_STANDINGS","raceId":1,"startAt":<server ms>,"standings":[{"place":1,"teamId":"...","clientId":2,"elapsedMs":...}]}
+//
+// Starting another race replaces the current one.
+type Race struct {
+	id       uint64
+	startAt  time.Time
+	finishes []RaceFinish
+}
+
+func (c *Client) startRace(packet string) {
+	if c.room.ownerClientId() != c.id {
+		sendServerMessage(c, "Only the room owner can start a race")
+		return
+	}
+
+	countdown := DEFAULT_RACE_COUNTDOWN
+	if countdownMs := gjson.Get(packet, "countdownMs"); countdownMs.Exists() {
+		countdown = time.Duration(countdownMs.Int()) * time.Millisecond
+	}
+	countdown = min(max(countdown, 0), MAX_RACE_COUNTDOWN)
+
+	now := time.Now()
+	c.room.mu.Lock()
+	race := &Race{startAt: now.Add(countdown)}
+	if c.room.race != nil {
+		race.id = c.room.race.id
+	}
+	race.id++
+	c.room.race = race
+	c.room.mu.Unlock()
+
+	log.Printf("Client %d started race %d in room %s, starting in %s\n", c.id, race.id, c.room.id, countdown)
+	c.room.broadcastPacket(race.startPacket(now, countdown))
+}
+
+// Catches up a client joining while a race is counting down or running
+func (c *Client) sendRaceState() {
+	c.room.mu.Lock()
+	race := c.room.race
+	if race == nil {
+		c.room.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	startPacket := race.startPacket(now, max(race.startAt.Sub(now), 0))
+	standingsPacket := ""
+	if len(race.finishes) > 0 {
+		standingsPacket = race.standingsPacket()
+	}
+	c.room.mu.Unlock()
+
+	c.sendPacket(startPacket)
+	if standingsPacket != "" {
+		c.sendPacket(standingsPacket)
+	}
+}
+
+func (r *Race) startPacket(now time.Time, countdown time.Duration) string {
+	outgoingPacket, _ := sjson.Set(`{"type":"RACE_START"}`, "raceId", r.id)
+	outgoingPacket, _ = sjson.Set(outgoingPacket, "startAt", r.startAt.UnixMilli())
+	outgoingPacket, _ = sjson.Set(outgoingPacket, "countdownMs", countdown.Milliseconds())
+	outgoingPacket, _ = sjson.Set(outgoingPacket, "serverTime", now.UnixMilli())
+	return outgoingPacket
+}
+
+// Records the client's team as finished if a race is running and the team
+// hasn't already finished, then sends the standings to the room
+func (c *Client) finishRace() {
+	c.mu.Lock()
+	team := c.team
+	c.mu.Unlock()
+
+	teamId := ""
+	if team != nil {
+		teamId = team.id
+	}
+
+	now := time.Now()
+	c.room.mu.Lock()
+	race := c.room.race
+	if race == nil || now.Before(race.startAt) {
+		c.room.mu.Unlock()
+		return
+	}
+	for _, finish := range race.finishes {
+		if finish.teamId == teamId {
+			c.room.mu.Unlock()
+			return
+		}
+	}
+	race.finishes = append(race.finishes, RaceFinish{teamId: teamId, clientId: c.id, elapsed: now.Sub(race.startAt)})
+	outgoingPacket := race.standingsPacket()
+	c.room.mu.Unlock()
+
+	c.room.broadcastPacket(outgoingPacket)
+}
+
+// Must be called with the room mutex held
+func (r *Race) standingsPacket() string {
+	outgoingPacket, _ := sjson.Set(`{"type":"RACE_STANDINGS"}`, "raceId", r.id)
+	outgoingPacket, _ = sjson.Set(outgoingPacket, "startAt", r.startAt.UnixMilli())
+	outgoingPacket, _ = sjson.SetRaw(outgoingPacket, "standings", `[]`)
+	for i, finish := range r.finishes {
+		path := fmt.Sprintf("standings.%d", i)
+		outgoingPacket, _ = sjson.Set(outgoingPacket, path+".place", i+1)
+		outgoingPacket, _ = sjson.Set(outgoingPacket, path+".teamId", finish.teamId)
+		outgoingPacket, _ = sjson.Set(outgoingPacket, path+".clientId", finish.clientId)
+		outgoingPacket, _ = sjson.Set(outgoingPacket, path+".elapsedMs", finish.elapsed.Milliseconds())
+	}
+	return outgoingPacket
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+var RESERVED_ROOMS_FILE = dataPath("reserved.json")
+
+const ROOM_PASSWORD_MESSAGE = "This room is reserved and needs the right password to join"
+
+// A room created by an admin. It starts from roomState whenever it has to be
+// created, is never deleted for inactivity and, with a password set, only
+// accepts handshakes carrying a matching "password".
+type ReservedRoom struct {
+	roomId       string
+	roomState    string
+	passwordHash string // "sha256:<salt>:<hash>" in hex, empty without a password
+	operator     string
+	created      time.Time
+}
+
+type ReservedRooms struct {
+	path  string
+	rooms map[string]*ReservedRoom
+	mu    sync.Mutex // Mutex for safely updating rooms
+}
+
+func NewReservedRooms(path string) *ReservedRooms {
+	return &ReservedRooms{path: path, rooms: make(map[string]*ReservedRoom)}
+}
+
+func (l *ReservedRooms) load() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	value, err := os.ReadFile(l.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if !gjson.ValidBytes(value) {
+		return fmt.Errorf("%s is not valid JSON", l.path)
+	}
+
+	l.rooms = make(map[string]*ReservedRoom)
+	plaintext := false
+	for _, entry := range gjson.ParseBytes(value).Array() {
+		reserved := &ReservedRoom{
+			roomId:       entry.Get("roomId").String(),
+			roomState:    entry.Get("roomState").Raw,
+			passwordHash: entry.Get("passwordHash").String(),
+			operator:     entry.Get("operator").String(),
+			created:      time.UnixMilli(entry.Get("created").Int()),
+		}
+		if !gjson.Parse(reserved.roomState).IsObject() {
+			reserved.roomState = "{}"
+		}
+		// Files from before passwords were hashed
+		if password := entry.Get("password").String(); password != "" {
+			reserved.passwordHash = hashPassword(password)
+			plaintext = true
+		}
+		l.rooms[reserved.roomId] = reserved
+	}
+	if plaintext {
+		l.saveLocked()
+	}
+
+	return nil
+}
+
+func (l *ReservedRooms) saveLocked() {
+	value := `[]`
+	for i, reserved := range l.listLocked() {
+		path := fmt.Sprint(i)
+		value, _ = sjson.Set(value, path+".roomId", reserved.roomId)
+		value, _ = sjson.SetRaw(value, path+".roomState", reserved.roomState)
+		value, _ = sjson.Set(value, path+".passwordHash", reserved.passwordHash)
+		value, _ = sjson.Set(value, path+".operator", reserved.operator)
+		value, _ = sjson.Set(value, path+".created", reserved.created.UnixMilli())
+	}
+
+	if err := writeFileAtomicMode(l.path, []byte(value), 0600); err != nil {
+		log.Println("Error writing reserved rooms file:", err)
+	}
+}
+
+func (l *ReservedRooms) listLocked() []*ReservedRoom {
+	list := make([]*ReservedRoom, 0, len(l.rooms))
+	for _, reserved := range l.rooms {
+		list = append(list, reserved)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].roomId < list[j].roomId })
+	return list
+}
+
+func (l *ReservedRooms) list() []ReservedRoom {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	list := []ReservedRoom{}
+	for _, reserved := range l.listLocked() {
+		list = append(list, *reserved)
+	}
+	return list
+}
+
+// Returns a copy of the reservation, or nil if the room isn't reserved
+func (l *ReservedRooms) get(roomId string) *ReservedRoom {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	reserved, ok := l.rooms[roomId]
+	if !ok {
+		return nil
+	}
+	copied := *reserved
+	return &copied
+}
+
+// Reserves a room or updates its password, keeping any preset state. A nil
+// password leaves the current one as it is, an empty one removes it. Returns
+// a copy of the reservation.
+func (l *ReservedRooms) reserve(roomId string, password *string, roomState string, operator string) ReservedRoom {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	reserved, ok := l.rooms[roomId]
+	if !ok {
+		reserved = &ReservedRoom{roomId: roomId, roomState: roomState, operator: operator, created: time.Now()}
+		l.rooms[roomId] = reserved
+	}
+	if password != nil {
+		reserved.passwordHash = ""
+		if *password != "" {
+			reserved.passwordHash = hashPassword(*password)
+		}
+	}
+	l.saveLocked()
+	return *reserved
+}
+
+func (l *ReservedRooms) setState(roomId string, roomState string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	reserved, ok := l.rooms[roomId]
+	if !ok {
+		return false
+	}
+	reserved.roomState = roomState
+	l.saveLocked()
+	return true
+}
+
+func (l *ReservedRooms) remove(roomId string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if _, ok := l.rooms[roomId]; !ok {
+		return false
+	}
+	delete(l.rooms, roomId)
+	l.saveLocked()
+	return true
+}
+
+// Saves the live state and team saves of every reserved room to the archive,
+// where the first handshake after a restart picks them up again
+func (s *Server) saveReservedRooms() {
+	for _, reserved := range s.reserved.list() {
+		if value, ok := s.rooms.Load(reserved.roomId); ok {
+			s.writeArchive(value.(*Room))
+		}
+	}
+}
+
+func hashPassword(password string) string {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	return "sha256:" + hex.EncodeToString(salt) + ":" + saltedHash(salt, password)
+}
+
+func saltedHash(salt []byte, password string) string {
+	sum := sha256.Sum256(append(append([]byte{}, salt...), password...))
+	return hex.EncodeToString(sum[:])
+}
+
+func (r *ReservedRoom) hasPassword() bool {
+	return r.passwordHash != ""
+}
+
+func (r *ReservedRoom) checkPassword(password string) bool {
+	if !r.hasPassword() {
+		return true
+	}
+
+	parts := strings.Split(r.passwordHash, ":")
+	if len(parts) != 3 || parts[0] != "sha256" {
+		return false
+	}
+	salt, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(saltedHash(salt, password)), []byte(parts[2])) == 1
+}
+
+// Replaces the room state on behalf of an admin, keeping the owner, and
+// sends it to everyone in the room
+func (r *Room) replaceState(state string) {
+	r.mu.Lock()
+	if owner := gjson.Get(r.state, "ownerClientId"); owner.Exists() {
+		state, _ = sjson.Set(state, "ownerClientId", owner.Uint())
+	}
+	r.charge(len(state) - len(r.state))
+	r.state = state
+	r.version++
+	packet, _ := sjson.SetRaw(`{"type":"UPDATE_ROOM_STATE"}`, "state", r.state)
+	packet, _ = sjson.Set(packet, "version", r.version)
+	r.mu.Unlock()
+
+	r.broadcastPacket(packet)
+}
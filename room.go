@@ -1,8 +1,10 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tidwall/gjson"
@@ -10,24 +12,91 @@ import (
 )
 
 type Room struct {
-	id      string
-	clients sync.Map
-	teams   sync.Map
-	state   string     // Room Settings
-	mu      sync.Mutex // Mutex for safely updating state
+	id          string
+	clients     sync.Map
+	teams       sync.Map
+	state       string   // Room Settings
+	version     uint64   // Bumped on every state change, for compare-and-set
+	chatHistory []string // Ring buffer of the most recent CHAT_MESSAGE packets
+	chatNext    int      // Index in chatHistory the next message is written to
+	createdAt   time.Time
+	race        *Race // Nil until the owner starts a race
+	server      *Server
+	usage       atomic.Int64 // Bytes of room, team and client state held, see budget.go
+	released    bool         // Removed from the server, usage no longer counts towards its total
+	usageMu     sync.Mutex   // Mutex for safely updating released against charges
+	lifecycle   string       // One of the ROOM_ lifecycle states, see lifecycle.go
+	emptySince  time.Time    // When the last connected member left, zero while anyone is connected
+	closed      bool         // Being removed, nobody can join it anymore, see lifecycle.go
+	archived    string       // Last archive written for the room, to skip unchanged saves
+	mu          sync.Mutex   // Mutex for safely updating state
 }
 
-func NewRoom(id string, ownerClientId uint64, packet string) *Room {
+func NewRoom(server *Server, id string, ownerClientId uint64, packet string) *Room {
 	roomState, _ := sjson.Set(gjson.Get(packet, "roomState").Raw, "ownerClientId", ownerClientId)
 
 	return &Room{
-		id:      id,
-		clients: sync.Map{},
-		teams:   sync.Map{},
-		state:   roomState,
+		id:        id,
+		clients:   sync.Map{},
+		teams:     sync.Map{},
+		state:     roomState,
+		createdAt: time.Now(),
+		server:    server,
+		lifecycle: ROOM_ACTIVE,
 	}
 }
 
+func (r *Room) ownerClientId() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return gjson.Get(r.state, "ownerClientId").Uint()
+}
+
+// Replaces the state with the result of update and returns the new state and
+// version, or the current ones and an error if the change is not allowed. A
+// baseVersion, when given, must match the current version. While the state
+// has "ownerOnly" set only the owner can change it, and only the owner can
+// set or clear "ownerOnly" or change "ownerClientId".
+func (r *Room) updateState(clientId uint64, baseVersion gjson.Result, update func(state string) (string, error)) (string, uint64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	owner := gjson.Get(r.state, "ownerClientId")
+	isOwner := !owner.Exists() || owner.Uint() == clientId
+	ownerOnly := gjson.Get(r.state, "ownerOnly").Bool()
+	if ownerOnly && !isOwner {
+		return r.state, r.version, errors.New("only the room owner can change room settings")
+	}
+	if baseVersion.Exists() && baseVersion.Uint() != r.version {
+		return r.state, r.version, fmt.Errorf("room state is at version %d, not %d", r.version, baseVersion.Uint())
+	}
+
+	state, err := update(r.state)
+	if err != nil {
+		return r.state, r.version, err
+	}
+	if !gjson.Parse(state).IsObject() {
+		return r.state, r.version, errors.New("room state must be an object")
+	}
+	if gjson.Get(state, "ownerOnly").Bool() != ownerOnly && !isOwner {
+		return r.state, r.version, errors.New("only the room owner can change ownerOnly")
+	}
+	// Only the owner can hand the room to someone else, anything else sent
+	// as ownerClientId is replaced with the current owner
+	if newOwner := gjson.Get(state, "ownerClientId"); !owner.Exists() {
+		state, _ = sjson.Delete(state, "ownerClientId")
+	} else if !isOwner || newOwner.Type != gjson.Number {
+		state, _ = sjson.Set(state, "ownerClientId", owner.Uint())
+	}
+	if !r.tryCharge(len(state) - len(r.state)) {
+		return r.state, r.version, errors.New("room is out of space on the server")
+	}
+
+	r.state = state
+	r.version++
+	return r.state, r.version, nil
+}
+
 func (r *Room) findOrCreateTeam(teamId string) *Team {
 	value, ok := r.teams.Load(teamId)
 	if !ok {
@@ -36,6 +105,7 @@ func (r *Room) findOrCreateTeam(teamId string) *Team {
 			state: "{}",
 			room:  r,
 			queue: make([]string, 0),
+			used:  time.Now(),
 		})
 	}
 
@@ -44,6 +114,7 @@ func (r *Room) findOrCreateTeam(teamId string) *Team {
 
 func (r *Room) broadcastPacket(packet string) {
 	clientId := gjson.Get(packet, "clientId").Uint()
+	packet = stampServerTime(packet)
 
 	r.clients.Range(func(_, value interface{}) bool {
 		client := value.(*Client)
@@ -55,6 +126,34 @@ func (r *Room) broadcastPacket(packet string) {
 	})
 }
 
+func (r *Room) addChatMessage(packet string) {
+	if CHAT_HISTORY_SIZE <= 0 {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.chatHistory) < CHAT_HISTORY_SIZE {
+		r.chatHistory = append(r.chatHistory, packet)
+		return
+	}
+
+	r.chatHistory[r.chatNext] = packet
+	r.chatNext = (r.chatNext + 1) % len(r.chatHistory)
+}
+
+// Returns the buffered chat messages, oldest first
+func (r *Room) getChatHistory() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	history := make([]string, 0, len(r.chatHistory))
+	history = append(history, r.chatHistory[r.chatNext:]...)
+	history = append(history, r.chatHistory[:r.chatNext]...)
+	return history
+}
+
 func (r *Room) broadcastAllClientState() {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -69,6 +168,12 @@ func (r *Room) broadcastAllClientState() {
 		idToIndex[id] = index
 		client.mu.Lock()
 		packet, _ = sjson.SetRaw(packet, "state."+fmt.Sprint(index), client.state)
+		if SHARE_CLIENT_RTT {
+			packet, _ = sjson.Set(packet, "state."+fmt.Sprint(index)+".rtt", client.rtt.Milliseconds())
+		}
+		if client.pinned {
+			packet, _ = sjson.Set(packet, "state."+fmt.Sprint(index)+".pinned", true)
+		}
 		client.mu.Unlock()
 		index++
 		return true
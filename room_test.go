@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tidwall/gjson"
+)
+
+func newTestRoom(t *testing.T) *Room {
+	t.Helper()
+	s := NewServer()
+	room := NewRoom(s, "test", 1, `{"roomState":{}}`)
+	s.rooms.Store(room.id, room)
+	room.charge(room.initialUsage())
+	return room
+}
+
+// Adds a client to the team, connected or not. Connected clients get a conn
+// but no send queue, so packets sent to them are dropped.
+func addTestClient(t *testing.T, room *Room, id uint64, team *Team, connected bool) *Client {
+	t.Helper()
+	client := &Client{
+		id:           id,
+		server:       room.server,
+		room:         room,
+		team:         team,
+		state:        "{}",
+		lastActivity: time.Now(),
+	}
+	if connected {
+		conn, other := net.Pipe()
+		t.Cleanup(func() {
+			conn.Close()
+			other.Close()
+		})
+		client.conn = conn
+	}
+	room.clients.Store(id, client)
+	return client
+}
+
+// Sets the budgets for the duration of the test
+func setTestBudgets(t *testing.T, roomBytes int, totalBytes int) {
+	t.Helper()
+	previousRoom, previousTotal := MAX_ROOM_BYTES, MAX_TOTAL_BYTES
+	MAX_ROOM_BYTES, MAX_TOTAL_BYTES = roomBytes, totalBytes
+	t.Cleanup(func() {
+		MAX_ROOM_BYTES, MAX_TOTAL_BYTES = previousRoom, previousTotal
+	})
+}
+
+func TestUpdateStateOwner(t *testing.T) {
+	tests := []struct {
+		name      string
+		state     string
+		clientId  uint64
+		packet    string
+		wantState string
+		wantErr   bool
+	}{
+		{
+			name:      "anyone can change settings without ownerOnly",
+			state:     `{"ownerClientId":1,"a":1}`,
+			clientId:  2,
+			packet:    `{"mergePatch":{"a":2}}`,
+			wantState: `{"ownerClientId":1,"a":2}`,
+		},
+		{
+			name:      "a non-owner can't claim the room",
+			state:     `{"ownerClientId":1}`,
+			clientId:  2,
+			packet:    `{"ops":[{"op":"set","path":"ownerClientId","value":2}]}`,
+			wantState: `{"ownerClientId":1}`,
+		},
+		{
+			name:      "a non-owner can't remove the owner",
+			state:     `{"ownerClientId":1}`,
+			clientId:  2,
+			packet:    `{"ops":[{"op":"delete","path":"ownerClientId"}]}`,
+			wantState: `{"ownerClientId":1}`,
+		},
+		{
+			name:      "the owner can hand the room over",
+			state:     `{"ownerClientId":1}`,
+			clientId:  1,
+			packet:    `{"ops":[{"op":"set","path":"ownerClientId","value":2}]}`,
+			wantState: `{"ownerClientId":2}`,
+		},
+		{
+			name:      "the owner keeps the room when leaving ownerClientId out",
+			state:     `{"ownerClientId":1}`,
+			clientId:  1,
+			packet:    `{"ops":[{"op":"delete","path":"ownerClientId"}]}`,
+			wantState: `{"ownerClientId":1}`,
+		},
+		{
+			name:      "a room without an owner can't be claimed",
+			state:     `{}`,
+			clientId:  2,
+			packet:    `{"ops":[{"op":"set","path":"ownerClientId","value":2}]}`,
+			wantState: `{}`,
+		},
+		{
+			name:      "a non-owner can't turn on ownerOnly",
+			state:     `{"ownerClientId":1}`,
+			clientId:  2,
+			packet:    `{"mergePatch":{"ownerOnly":true}}`,
+			wantState: `{"ownerClientId":1}`,
+			wantErr:   true,
+		},
+		{
+			name:      "a non-owner can't change an ownerOnly room",
+			state:     `{"ownerClientId":1,"ownerOnly":true}`,
+			clientId:  2,
+			packet:    `{"mergePatch":{"a":1}}`,
+			wantState: `{"ownerClientId":1,"ownerOnly":true}`,
+			wantErr:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			room := newTestRoom(t)
+			room.state = test.state
+
+			state, _, err := room.updateState(test.clientId, gjson.Result{}, func(state string) (string, error) {
+				return applyPatchPacket(state, test.packet)
+			})
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error %t", err, test.wantErr)
+			}
+			if !jsonEqual(state, test.wantState) {
+				t.Errorf("got state %s, want %s", state, test.wantState)
+			}
+		})
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// Removes clients that have been offline for longer than
+// OFFLINE_CLIENT_GRACE from their rooms, unless pinned
+func (s *Server) pruneOfflineClients(errChan chan error) {
+	if OFFLINE_CLIENT_GRACE <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(min(HEARTBEAT, OFFLINE_CLIENT_GRACE))
+	defer ticker.Stop()
+	defer func() {
+		if r := recover(); r != nil {
+			errChan <- fmt.Errorf("panic in pruneOfflineClients: %v", r)
+		}
+	}()
+
+	for range ticker.C {
+		s.rooms.Range(func(_, value interface{}) bool {
+			value.(*Room).pruneOfflineClients()
+			return true
+		})
+	}
+}
+
+func (r *Room) pruneOfflineClients() {
+	removed := []uint64{}
+	r.clients.Range(func(id, value interface{}) bool {
+		client := value.(*Client)
+		client.mu.Lock()
+		if client.conn == nil && !client.pinned && time.Since(client.offlineSince) > OFFLINE_CLIENT_GRACE {
+			// Marked under the lock so a reconnect racing with this starts fresh
+			client.removed = true
+			r.clients.CompareAndDelete(id, client)
+			r.charge(-len(client.state))
+			removed = append(removed, client.id)
+		}
+		client.mu.Unlock()
+		return true
+	})
+
+	if len(removed) == 0 {
+		return
+	}
+
+	for _, clientId := range removed {
+		log.Printf("Removing client %d from room %s, offline for over %v\n", clientId, r.id, OFFLINE_CLIENT_GRACE)
+		packet, _ := sjson.Set(`{"type":"CLIENT_LEFT"}`, "clientId", clientId)
+		r.broadcastPacket(packet)
+	}
+	r.broadcastAllClientState()
+}
+
+// Pins or unpins a roster entry so it is kept while offline. Allowed for the
+// room owner, and for members of the same team:
+//
+//	-> {"type":"PIN_CLIENT","pinClientId":5,"pinned":true}
+func (c *Client) pinClient(packet string) {
+	value, ok := c.room.clients.Load(gjson.Get(packet, "pinClientId").Uint())
+	if !ok {
+		return
+	}
+	target := value.(*Client)
+
+	isOwner := c.room.ownerClientId() == c.id
+	c.mu.Lock()
+	team := c.team
+	c.mu.Unlock()
+
+	pinned := gjson.Get(packet, "pinned")
+	target.mu.Lock()
+	allowed := isOwner || target.team == team
+	if allowed {
+		target.pinned = !pinned.Exists() || pinned.Bool()
+	}
+	target.mu.Unlock()
+
+	if !allowed {
+		sendServerMessage(c, "Only the room owner or a teammate can pin a client")
+		return
+	}
+	c.room.broadcastAllClientState()
+}
+
+// Moves the client to another room without reconnecting. Takes the same
+// roomId, roomState, clientState and password fields as a handshake:
+//
+//	-> {"type":"JOIN_ROOM","roomId":"...","roomState":{...},"clientState":{...}}
+//
+// The old room gets a CLIENT_LEFT and both rooms an updated ALL_CLIENT_STATE,
+// then the client is sent the new room's state.
+func (c *Client) joinRoom(packet string) {
+	roomId := gjson.Get(packet, "roomId").String()
+	oldRoom := c.room
+	if roomId == oldRoom.id {
+		c.sendRoomState()
+		return
+	}
+
+	if reserved := c.server.reserved.get(roomId); reserved != nil && !reserved.checkPassword(gjson.Get(packet, "password").String()) {
+		sendServerMessage(c, ROOM_PASSWORD_MESSAGE)
+		return
+	}
+
+	c.mu.Lock()
+	state := c.state
+	c.mu.Unlock()
+	if clientState := gjson.Get(packet, "clientState"); clientState.IsObject() {
+		filtered := c.server.filter.Load().filterClientState(packet, "clientState.")
+		filtered.log(fmt.Sprintf("client %d", c.id))
+		if filtered.rejected {
+			sendServerMessage(c, FILTER_REJECT_MESSAGE)
+			return
+		}
+		packet = filtered.packet
+		state, _ = sjson.Set(gjson.Get(packet, "clientState").Raw, "clientId", c.id)
+	}
+
+	var room *Room
+	var oldTeam *Team
+	for {
+		var err error
+		room, err = c.server.findOrCreateRoom(packet, c.id)
+		if err != nil {
+			sendServerMessage(c, ROOM_FULL_MESSAGE)
+			return
+		}
+		team := room.findOrCreateTeam(gjson.Get(state, "teamId").String())
+		room.mu.Lock()
+		game := gameFromState(state, room.state)
+		room.mu.Unlock()
+		game = c.server.games.track(game)
+
+		var stale *Client
+		delta := len(state)
+		if value, ok := room.clients.Load(c.id); ok {
+			stale = value.(*Client)
+			stale.mu.Lock()
+			if !stale.removed {
+				delta -= len(stale.state)
+			}
+			stale.mu.Unlock()
+		}
+		if !room.reserve(delta, team) {
+			sendServerMessage(c, ROOM_FULL_MESSAGE)
+			return
+		}
+
+		entered := room.enter(func() {
+			// Replace any entry left over from an earlier visit
+			if stale != nil {
+				stale.mu.Lock()
+				if !stale.removed {
+					stale.removed = true
+					room.charge(-len(stale.state))
+				}
+				stale.mu.Unlock()
+			}
+
+			c.mu.Lock()
+			room.clients.Store(c.id, c)
+			oldRoom.clients.CompareAndDelete(c.id, c)
+			oldRoom.charge(-len(c.state))
+			room.charge(len(state))
+			oldTeam = c.team
+			c.room = room
+			c.team = team
+			c.state = state
+			c.game = game
+			c.lastActivity = time.Now()
+			c.mu.Unlock()
+		})
+		// The charges above replace the reservation
+		room.charge(-delta)
+		if entered {
+			break
+		}
+
+		// Cleanup closed the room as we got to it, join the one replacing it
+		c.server.awaitRemoval(room)
+	}
+
+	// Teammates left behind won't answer a request for this client anymore
+	if oldTeam != nil {
+		oldTeam.dropStateRequest(c.id)
+	}
+
+	log.Printf("Client %d moved from room %s to room %s\n", c.id, oldRoom.id, room.id)
+
+	left, _ := sjson.Set(`{"type":"CLIENT_LEFT"}`, "clientId", c.id)
+	oldRoom.broadcastPacket(left)
+	oldRoom.broadcastAllClientState()
+
+	room.broadcastAllClientState()
+	c.sendRoomState()
+	c.sendChatHistory()
+	c.sendRaceState()
+}
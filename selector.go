@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/gjson"
+)
+
+const SELECTOR_HELP = "all, <clientId>, room:<roomId>, team:<roomId>/<teamId> or query:<gjson condition on client state>, e.g. query:clientVersion%\"*1.2*\""
+
+// Resolves an admin selector to the online clients it targets:
+//
+//	all                     every online client
+//	<clientId>              a single client
+//	room:<roomId>           clients in a room
+//	team:<roomId>/<teamId>  clients on a team within a room
+//	query:<condition>       clients whose state matches a gjson query condition
+func (s *Server) selectClients(selector string) ([]*Client, error) {
+	var matches func(client *Client) bool
+
+	kind, value, _ := strings.Cut(selector, ":")
+	switch kind {
+	case "all":
+		matches = func(_ *Client) bool { return true }
+	case "room":
+		matches = func(client *Client) bool { return client.getRoom().id == value }
+	case "team":
+		separator := strings.LastIndex(value, "/")
+		if separator == -1 {
+			return nil, fmt.Errorf("team selector must look like team:<roomId>/<teamId>")
+		}
+		roomId, teamId := value[:separator], value[separator+1:]
+		matches = func(client *Client) bool {
+			room := client.getRoom()
+			client.mu.Lock()
+			defer client.mu.Unlock()
+			return room.id == roomId && client.team != nil && client.team.id == teamId
+		}
+	case "query":
+		if value == "" {
+			return nil, fmt.Errorf("query selector needs a condition")
+		}
+		matches = func(client *Client) bool {
+			client.mu.Lock()
+			state := client.state
+			client.mu.Unlock()
+			return gjson.Get("["+state+"]", "#("+value+")").Exists()
+		}
+	default:
+		clientId, err := strconv.ParseUint(selector, 10, 64)
+		if err != nil || clientId == 0 {
+			return nil, fmt.Errorf("unknown selector %q, expected %s", selector, SELECTOR_HELP)
+		}
+		matches = func(client *Client) bool { return client.id == clientId }
+	}
+
+	clients := []*Client{}
+	s.onlineClients.Range(func(_, value interface{}) bool {
+		client := value.(*Client)
+		if matches(client) {
+			clients = append(clients, client)
+		}
+		return true
+	})
+
+	return clients, nil
+}
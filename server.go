@@ -17,7 +17,7 @@ import (
 	"github.com/tidwall/sjson"
 )
 
-const JSON_TEMPLATE = `{"gameCompleteCount":0,"onlineCount":0,"lastStatsHeartbeat":"","uniqueCount":0,"pid":0}`
+const JSON_TEMPLATE = `{"version":0,"gameCompleteCount":0,"onlineCount":0,"averageRtt":0,"lastStatsHeartbeat":"","uniqueCount":0,"games":{},"pid":0}`
 const INACTIVITY_TIMEOUT = 5 * time.Minute
 const HEARTBEAT = 30 * time.Second
 const MAX_PACKET_SIZE = 8 * 1024 * 1024
@@ -25,11 +25,23 @@ const INITIAL_SCAN_BUFFER = 64 * 1024
 
 type Server struct {
 	listener          net.Listener
+	controlListener   net.Listener
 	quietMode         atomic.Bool
 	onlineClients     sync.Map
 	rooms             sync.Map
 	gameCompleteCount atomic.Uint64
 	nextClientId      atomic.Uint64
+	audit             *AuditLog
+	bans              *BanList
+	limiter           *ConnectionLimiter
+	filter            atomic.Pointer[WordFilter]
+	history           *StatsHistory
+	games             *GameStats
+	statsMu           sync.Mutex // Serializes writes of stats.json and its backup
+	webhooks          *Webhooks
+	completions       *CompletionLog
+	usage             atomic.Int64 // Bytes held by all rooms, see budget.go
+	reserved          *ReservedRooms
 }
 
 func NewServer() *Server {
@@ -39,6 +51,14 @@ func NewServer() *Server {
 		rooms:             sync.Map{},
 		gameCompleteCount: atomic.Uint64{},
 		nextClientId:      atomic.Uint64{},
+		audit:             NewAuditLog(AUDIT_FILE),
+		bans:              NewBanList(BANS_FILE),
+		limiter:           NewConnectionLimiter(),
+		history:           NewStatsHistory(HISTORY_DIR),
+		games:             NewGameStats(),
+		webhooks:          &Webhooks{},
+		completions:       NewCompletionLog(COMPLETIONS_FILE),
+		reserved:          NewReservedRooms(RESERVED_ROOMS_FILE),
 	}
 
 	s.quietMode.Store(true)
@@ -47,19 +67,50 @@ func NewServer() *Server {
 }
 
 func (s *Server) Start(errChan chan error) {
+	if err := os.MkdirAll(DATA_DIR, 0755); err != nil {
+		log.Fatal("Error creating data directory: ", err)
+	}
+	if err := s.bans.load(); err != nil {
+		log.Fatal("Error loading bans: ", err)
+	}
+	if err := s.loadFilter(); err != nil {
+		log.Fatal("Error loading word filter: ", err)
+	}
+	if err := s.parseStats(); err != nil {
+		log.Fatal("Error loading stats: ", err)
+	}
+	if err := s.completions.load(); err != nil {
+		log.Fatal("Error loading completions: ", err)
+	}
+	if err := s.reserved.load(); err != nil {
+		log.Fatal("Error loading reserved rooms: ", err)
+	}
+	webhooks, err := loadWebhooks(WEBHOOKS_FILE)
+	if err != nil {
+		log.Fatal("Error loading webhooks: ", err)
+	}
+	s.webhooks = webhooks
+
 	listener, err := net.Listen("tcp", ":43383")
 	if err != nil {
 		log.Fatal(err)
 	}
 	s.listener = listener
 
+	if s.controlListener = s.listenControl(); s.controlListener != nil {
+		go s.serveControl(s.controlListener, errChan)
+	}
 	go s.cleanupInactiveRooms(errChan)
 	go s.heartbeat(errChan)
-	go s.parseStats(errChan)
+	go s.pingClients(errChan)
 	go s.statsHeartbeat(errChan)
+	go s.recordHistory(errChan)
+	go s.pruneOfflineClients(errChan)
+	go s.pruneArchive(errChan)
 
 	log.Println("Server running on :43383")
 	log.Println("Quiet mode:", s.quietMode.Load())
+	s.webhooks.emit(EVENT_SERVER_START, fmt.Sprintf(`{"pid":%d}`, os.Getpid()))
 
 	for {
 		conn, err := listener.Accept()
@@ -73,28 +124,55 @@ func (s *Server) Start(errChan chan error) {
 			continue
 		}
 
+		if err := s.limiter.acquire(remoteIP(conn)); err != nil {
+			log.Printf("Refusing connection from %s: %v\n", remoteIP(conn), err)
+			conn.Close()
+			continue
+		}
+
 		go s.handleConnection(conn, errChan)
 	}
 }
 
-func (s *Server) parseStats(errChan chan error) {
-	defer func() {
-		if r := recover(); r != nil {
-			errChan <- fmt.Errorf("panic in parseStats: %v", r)
-		}
-	}()
+func (s *Server) shutdown() {
+	s.saveStats()
+	s.saveReservedRooms()
+	s.history.flush()
+	s.webhooks.emit(EVENT_SERVER_STOP, fmt.Sprintf(`{"pid":%d}`, os.Getpid()))
+	s.webhooks.drain(5 * time.Second)
+	if s.controlListener != nil {
+		s.controlListener.Close()
+	}
+	// Start returns once the listener is closed, which ends the process
+	s.listener.Close()
+
+	os.Exit(0)
+}
 
-	value, err := os.ReadFile("stats.json")
+func (s *Server) loadFilter() error {
+	filter, err := loadWordFilter(FILTER_FILE)
 	if err != nil {
-		log.Println("Error reading stats.json file:", err)
+		return err
+	}
+
+	s.filter.Store(filter)
+	return nil
+}
+
+func (s *Server) parseStats() error {
+	value, err := loadStatsFile()
+	if err != nil {
+		return err
 	}
 
 	//input values into their repective fields of the server
-	s.gameCompleteCount.Store(gjson.Get(string(value), "gameCompleteCount").Uint())
-	s.nextClientId.Store(gjson.Get(string(value), "uniqueCount").Uint())
+	s.gameCompleteCount.Store(gjson.Get(value, "gameCompleteCount").Uint())
+	s.nextClientId.Store(gjson.Get(value, "uniqueCount").Uint())
+	s.games.load(gjson.Get(value, "games"))
 
 	// Save stats immediately to update lastStatsHeartbeat
 	s.saveStats()
+	return nil
 }
 
 func (s *Server) onlineCount() int {
@@ -106,14 +184,29 @@ func (s *Server) onlineCount() int {
 	return count
 }
 
+func (s *Server) roomCount() int {
+	var count int
+	s.rooms.Range(func(_, _ interface{}) bool {
+		count++
+		return true
+	})
+	return count
+}
+
 func (s *Server) saveStats() {
-	value, _ := sjson.Set(JSON_TEMPLATE, "gameCompleteCount", s.gameCompleteCount.Load())
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+
+	value, _ := sjson.Set(JSON_TEMPLATE, "version", STATS_SCHEMA_VERSION)
+	value, _ = sjson.Set(value, "gameCompleteCount", s.gameCompleteCount.Load())
 	value, _ = sjson.Set(value, "uniqueCount", s.nextClientId.Load())
 	value, _ = sjson.Set(value, "onlineCount", s.onlineCount())
+	value, _ = sjson.Set(value, "averageRtt", s.averageRtt())
+	value, _ = sjson.SetRaw(value, "games", s.gameStatsJson())
 	value, _ = sjson.Set(value, "lastStatsHeartbeat", time.Now().UnixMilli())
 	value, _ = sjson.Set(value, "pid", os.Getpid())
 
-	err := os.WriteFile("./stats.json", []byte(value), 0644)
+	err := writeStatsFile(value)
 
 	if err != nil {
 		log.Println("Error writing json to file: ", err)
@@ -129,19 +222,34 @@ func (s *Server) cleanupInactiveRooms(errChan chan error) {
 		}
 	}()
 
-	for range ticker.C {
+	for now := range ticker.C {
 		s.rooms.Range(func(id, value interface{}) bool {
 			room := value.(*Room)
-			lastActivity := room.GetLastActivity()
-			if time.Since(lastActivity) > INACTIVITY_TIMEOUT {
+			reserved := s.reserved.get(room.id) != nil
+			if reserved {
+				s.writeArchive(room)
+			}
+			if room.updateLifecycle(now, reserved) {
 				log.Println("Room", id, "has been inactive for too long, deleting it")
-				s.rooms.Delete(id)
+				s.archiveRoom(room)
+				s.removeRoom(room)
 			}
 			return true
 		})
 	}
 }
 
+// Closes and deletes the room and releases the bytes it held
+func (s *Server) removeRoom(room *Room) {
+	room.mu.Lock()
+	room.closed = true
+	room.mu.Unlock()
+
+	if s.rooms.CompareAndDelete(room.id, room) {
+		room.release()
+	}
+}
+
 func (s *Server) statsHeartbeat(errChan chan error) {
 	ticker := time.NewTicker(HEARTBEAT)
 	defer ticker.Stop()
@@ -170,18 +278,56 @@ func (s *Server) heartbeat(errChan chan error) {
 
 		s.onlineClients.Range(func(_, value interface{}) bool {
 			client := value.(*Client)
-			client.mu.Lock()
-			idle := time.Since(client.lastActivity) > HEARTBEAT
-			client.mu.Unlock()
-			if idle {
-				client.sendPacket(`{"type":"HEARTBEAT","quiet":true}`)
+			if !client.heartbeat() {
+				log.Printf("Client %d missed %d heartbeats, disconnecting\n", client.id, MAX_MISSED_HEARTBEATS)
+				client.expireConn()
 			}
 			return true
 		})
 	}
 }
 
+func (s *Server) pingClients(errChan chan error) {
+	if PING_INTERVAL <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(PING_INTERVAL)
+	defer ticker.Stop()
+	defer func() {
+		if r := recover(); r != nil {
+			errChan <- fmt.Errorf("panic in pingClients: %v", r)
+		}
+	}()
+
+	for range ticker.C {
+		s.onlineClients.Range(func(_, value interface{}) bool {
+			value.(*Client).ping()
+			return true
+		})
+	}
+}
+
+// Mean smoothed RTT in milliseconds across online clients that have answered a PING
+func (s *Server) averageRtt() int64 {
+	var total time.Duration
+	var count int64
+	s.onlineClients.Range(func(_, value interface{}) bool {
+		if rtt := value.(*Client).getRtt(); rtt > 0 {
+			total += rtt
+			count++
+		}
+		return true
+	})
+
+	if count == 0 {
+		return 0
+	}
+	return total.Milliseconds() / count
+}
+
 func (s *Server) handleConnection(conn net.Conn, errChan chan error) {
+	defer s.limiter.release(remoteIP(conn))
 	defer conn.Close()
 	defer func() {
 		if r := recover(); r != nil {
@@ -194,6 +340,10 @@ func (s *Server) handleConnection(conn net.Conn, errChan chan error) {
 	scanner.Split(splitNullByte)
 
 	var client *Client
+	var err error
+
+	// Sockets that never handshake are closed once the deadline passes
+	conn.SetReadDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
 
 	for scanner.Scan() {
 		packet := scanner.Text()
@@ -216,6 +366,8 @@ func (s *Server) handleConnection(conn net.Conn, errChan chan error) {
 			outgoingPacket, _ := sjson.Set(`{"type":"STATS"}`, "uniqueCount", s.nextClientId.Load())
 			outgoingPacket, _ = sjson.Set(outgoingPacket, "gameCompleteCount", s.gameCompleteCount.Load())
 			outgoingPacket, _ = sjson.Set(outgoingPacket, "onlineCount", s.onlineCount())
+			outgoingPacket, _ = sjson.Set(outgoingPacket, "averageRtt", s.averageRtt())
+			outgoingPacket, _ = sjson.SetRaw(outgoingPacket, "games", s.gameStatsJson())
 			conn.Write(append([]byte(outgoingPacket), 0))
 			continue
 		}
@@ -226,13 +378,49 @@ func (s *Server) handleConnection(conn net.Conn, errChan chan error) {
 				continue
 			}
 
-			client = s.findOrCreateClient(packet, conn)
+			if ban := s.bans.match(gjson.Get(packet, "clientId").Uint(), remoteIP(conn)); ban != nil {
+				log.Printf("Rejected handshake from %s, matched ban %d\n", remoteIP(conn), ban.id)
+				outgoingPacket, _ := sjson.Set(`{"type":"SERVER_MESSAGE"}`, "message", ban.message())
+				conn.Write(append([]byte(outgoingPacket), 0))
+				return
+			}
+
+			filtered := s.filter.Load().filterClientState(packet, "clientState.")
+			filtered.log(remoteIP(conn))
+			if filtered.rejected {
+				outgoingPacket, _ := sjson.Set(`{"type":"SERVER_MESSAGE"}`, "message", FILTER_REJECT_MESSAGE)
+				conn.Write(append([]byte(outgoingPacket), 0))
+				return
+			}
+			packet = filtered.packet
+
+			if reserved := s.reserved.get(gjson.Get(packet, "roomId").String()); reserved != nil && !reserved.checkPassword(gjson.Get(packet, "password").String()) {
+				log.Printf("Rejected handshake from %s, wrong password for reserved room %s\n", remoteIP(conn), reserved.roomId)
+				outgoingPacket, _ := sjson.Set(`{"type":"SERVER_MESSAGE"}`, "message", ROOM_PASSWORD_MESSAGE)
+				conn.Write(append([]byte(outgoingPacket), 0))
+				return
+			}
+
+			conn.SetReadDeadline(time.Time{})
+			client, err = s.findOrCreateClient(packet, conn)
+			if err != nil {
+				log.Printf("Rejected handshake from %s: %v\n", remoteIP(conn), err)
+				outgoingPacket, _ := sjson.Set(`{"type":"SERVER_MESSAGE"}`, "message", ROOM_FULL_MESSAGE)
+				conn.Write(append([]byte(outgoingPacket), 0))
+				return
+			}
 			log.Printf("Client %v Connected\n", client.id)
 			client.room.broadcastAllClientState()
 			client.sendRoomState()
+			client.sendChatHistory()
+			client.sendRaceState()
 		} else {
 			client.handlePacket(packet)
 		}
+
+		if timeout := client.readTimeout(); timeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(timeout))
+		}
 	}
 
 	if client != nil {
@@ -240,7 +428,9 @@ func (s *Server) handleConnection(conn net.Conn, errChan chan error) {
 		client.room.broadcastAllClientState()
 
 		if err := scanner.Err(); err != nil {
-			if errors.Is(err, bufio.ErrTooLong) {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				log.Printf("Client %v stopped responding, disconnecting", client.id)
+			} else if errors.Is(err, bufio.ErrTooLong) {
 				log.Printf("Client %v sent a packet over the %d byte limit, disconnecting", client.id, MAX_PACKET_SIZE)
 			} else {
 				log.Printf("Client %v disconnected with error: %v", client.id, err)
@@ -248,24 +438,26 @@ func (s *Server) handleConnection(conn net.Conn, errChan chan error) {
 		} else {
 			log.Printf("Client %v disconnected\n", client.id)
 		}
+	} else if errors.Is(scanner.Err(), os.ErrDeadlineExceeded) {
+		log.Printf("Closing connection from %s, no handshake within %v\n", remoteIP(conn), HANDSHAKE_TIMEOUT)
 	} else {
 		log.Println("Unknown client disconnected.")
 	}
 
 }
 
-func (s *Server) findOrCreateClient(packet string, conn net.Conn) *Client {
+// Returns errRoomFull, without changing anything, when the room can't take
+// the client's state
+func (s *Server) findOrCreateClient(packet string, conn net.Conn) (*Client, error) {
 	clientId := gjson.Get(packet, "clientId").Uint()
 	roomId := gjson.Get(packet, "roomId").String()
 
-	takeover := false
+	var stale *Client
 	if clientId != 0 {
 		if value, ok := s.onlineClients.Load(clientId); ok {
 			existing := value.(*Client)
-			if existing.room.id == roomId {
-				takeover = true
-				log.Printf("Client %v reconnected, closing stale session\n", clientId)
-				existing.disconnect()
+			if existing.getRoom().id == roomId {
+				stale = existing
 			} else {
 				clientId = 0
 			}
@@ -273,56 +465,148 @@ func (s *Server) findOrCreateClient(packet string, conn net.Conn) *Client {
 	}
 
 	// Check if the client id is already in use or is 0 and look for a new one
-	for !takeover {
+	newClient := false
+	for stale == nil {
 		if _, ok := s.onlineClients.Load(clientId); !ok && clientId != 0 {
 			break
 		}
 		clientId = s.nextClientId.Add(1)
+		newClient = true
+	}
+
+	for {
+		room, err := s.findOrCreateRoom(packet, clientId)
+		if err != nil {
+			return nil, err
+		}
+		client, err := s.enterRoom(room, packet, clientId, conn, stale, newClient)
+		if err != nil {
+			return nil, err
+		}
+		if client != nil {
+			return client, nil
+		}
+
+		// Cleanup closed the room as we got to it, join the one replacing it
+		s.awaitRemoval(room)
 	}
+}
 
-	room := s.findOrCreateRoom(packet, clientId)
+// Adds the client to the room, or returns nil if the room has been closed
+func (s *Server) enterRoom(room *Room, packet string, clientId uint64, conn net.Conn, stale *Client, newClient bool) (*Client, error) {
+	room.mu.Lock()
+	game := gameFromState(gjson.Get(packet, "clientState").Raw, room.state)
+	room.mu.Unlock()
+	game = s.games.track(game)
 	team := room.findOrCreateTeam(gjson.Get(packet, "clientState.teamId").String())
 
 	var client *Client
 	loadedClient, ok := room.clients.Load(clientId)
 	clientState, _ := sjson.Set(gjson.Get(packet, "clientState").Raw, "clientId", clientId)
+	delta := len(clientState)
 	if ok {
 		client = loadedClient.(*Client)
 		client.mu.Lock()
-		client.attachConnLocked(conn)
-		client.state = clientState
-		client.team = team
-		client.lastActivity = time.Now()
-		client.mu.Unlock()
-	} else {
-		client = &Client{
-			id:           clientId,
-			server:       s,
-			room:         room,
-			team:         team,
-			state:        clientState,
-			lastActivity: time.Now(),
+		if !client.removed {
+			delta -= len(client.state)
 		}
-		client.mu.Lock()
-		client.attachConnLocked(conn)
 		client.mu.Unlock()
-		room.clients.Store(clientId, client)
+	}
+	if !room.reserve(delta, team) {
+		return nil, errRoomFull
+	}
+
+	entered := room.enter(func() {
+		if stale != nil {
+			log.Printf("Client %v reconnected, closing stale session\n", clientId)
+			stale.disconnect()
+		}
+
+		if ok {
+			client.mu.Lock()
+			if client.removed {
+				client.mu.Unlock()
+				ok = false
+			}
+		}
+		if ok {
+			client.attachConnLocked(conn)
+			room.charge(len(clientState) - len(client.state))
+			client.state = clientState
+			client.team = team
+			client.game = game
+			client.lastActivity = time.Now()
+			client.mu.Unlock()
+		} else {
+			client = &Client{
+				id:           clientId,
+				server:       s,
+				room:         room,
+				team:         team,
+				state:        clientState,
+				game:         game,
+				lastActivity: time.Now(),
+			}
+			client.mu.Lock()
+			client.attachConnLocked(conn)
+			client.mu.Unlock()
+			room.charge(len(clientState))
+			room.clients.Store(clientId, client)
+		}
+	})
+	// The charges above replace the reservation
+	room.charge(-delta)
+	if !entered {
+		return nil, nil
 	}
 
+	if newClient {
+		s.games.addUnique(game)
+	}
 	s.onlineClients.Store(clientId, client)
 
-	return client
+	return client, nil
 }
 
-func (s *Server) findOrCreateRoom(packet string, clientId uint64) *Room {
+// Returns errRoomFull when a new room's initial state doesn't fit the budgets
+func (s *Server) findOrCreateRoom(packet string, clientId uint64) (*Room, error) {
 	roomId := gjson.Get(packet, "roomId").String()
 
 	room, ok := s.rooms.Load(roomId)
 	if !ok {
-		room, _ = s.rooms.LoadOrStore(roomId, NewRoom(roomId, clientId, packet))
+		newRoom := s.loadArchivedRoom(roomId)
+		restored := newRoom != nil
+		if !restored {
+			if reserved := s.reserved.get(roomId); reserved != nil {
+				packet, _ = sjson.SetRaw(packet, "roomState", reserved.roomState)
+			}
+			newRoom = NewRoom(s, roomId, clientId, packet)
+		}
+		if !newRoom.tryCharge(newRoom.initialUsage()) {
+			return nil, errRoomFull
+		}
+
+		var loaded bool
+		room, loaded = s.rooms.LoadOrStore(roomId, newRoom)
+		if loaded {
+			// Another handshake created it first
+			newRoom.release()
+		} else {
+			if restored {
+				log.Println("Restored room", roomId, "from the archive")
+				// Reserved rooms keep theirs, it is rewritten as they change
+				if s.reserved.get(roomId) == nil {
+					os.Remove(archivePath(roomId))
+				}
+			} else {
+				data, _ := sjson.Set(`{}`, "roomId", roomId)
+				data, _ = sjson.Set(data, "ownerClientId", clientId)
+				s.webhooks.emit(EVENT_ROOM_CREATE, data)
+			}
+		}
 	}
 
-	return room.(*Room)
+	return room.(*Room), nil
 }
 
 func splitNullByte(data []byte, atEOF bool) (advance int, token []byte, err error) {
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/tidwall/gjson"
+)
+
+var STATS_BACKUP_FILE = STATS_FILE + ".bak"
+
+// Where stats were kept before STATS_FILE was configurable
+const LEGACY_STATS_FILE = "./stats.json"
+
+// Bumped whenever stats.json changes shape. Files without a version predate it.
+const STATS_SCHEMA_VERSION = 1
+
+func validateStats(value []byte) error {
+	if !gjson.ValidBytes(value) {
+		return errors.New("not valid JSON")
+	}
+
+	stats := gjson.ParseBytes(value)
+	if version := stats.Get("version"); version.Exists() && version.Int() > STATS_SCHEMA_VERSION {
+		return fmt.Errorf("schema version %d is newer than this server understands (%d)", version.Int(), STATS_SCHEMA_VERSION)
+	}
+	for _, field := range []string{"gameCompleteCount", "uniqueCount"} {
+		if stats.Get(field).Type != gjson.Number {
+			return fmt.Errorf("%s is missing or not a number", field)
+		}
+	}
+	return nil
+}
+
+func readStatsFile(path string) ([]byte, error) {
+	value, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateStats(value); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return value, nil
+}
+
+var errNoStats = errors.New("no stats file")
+
+// Picks the stats to start from. A missing stats.json with no backup is a
+// fresh server, but a damaged one is never silently replaced with zeroes:
+// the backup generation is used instead, and if that is unusable too an error
+// is returned so the lifetime counters aren't reset. When STATS_FILE points
+// somewhere new, stats left at the old default path are carried over.
+func loadStatsFile() (string, error) {
+	value, err := loadStatsFrom(STATS_FILE, STATS_BACKUP_FILE)
+	if !errors.Is(err, errNoStats) {
+		return value, err
+	}
+
+	if filepath.Clean(STATS_FILE) != filepath.Clean(LEGACY_STATS_FILE) {
+		value, err = loadStatsFrom(LEGACY_STATS_FILE, LEGACY_STATS_FILE+".bak")
+		if err == nil {
+			log.Printf("No stats at %s, carrying over %s\n", STATS_FILE, LEGACY_STATS_FILE)
+			return value, nil
+		}
+		if !errors.Is(err, errNoStats) {
+			return "", err
+		}
+	}
+
+	log.Println("No stats.json found, starting with fresh stats")
+	return `{}`, nil
+}
+
+func loadStatsFrom(path string, backupPath string) (string, error) {
+	current, currentErr := readStatsFile(path)
+	backup, backupErr := readStatsFile(backupPath)
+
+	if currentErr == nil {
+		// Counters only ever go up, a current file behind its backup was reset somewhere
+		if backupErr == nil {
+			for _, field := range []string{"gameCompleteCount", "uniqueCount"} {
+				if gjson.GetBytes(current, field).Uint() < gjson.GetBytes(backup, field).Uint() {
+					log.Printf("%s has a lower %s than %s, using the backup\n", path, field, backupPath)
+					return string(backup), nil
+				}
+			}
+		}
+		return string(current), nil
+	}
+
+	if backupErr == nil {
+		log.Printf("Could not use %s (%v), restoring from %s\n", path, currentErr, backupPath)
+		return string(backup), nil
+	}
+
+	if errors.Is(currentErr, os.ErrNotExist) && errors.Is(backupErr, os.ErrNotExist) {
+		return "", errNoStats
+	}
+
+	return "", fmt.Errorf("refusing to reset lifetime stats, fix or remove %s and %s: %v; backup: %v",
+		path, backupPath, currentErr, backupErr)
+}
+
+// Keeps the previous generation as the backup, then atomically replaces
+// stats.json. If that fails the previous file is left as it was.
+func writeStatsFile(value string) error {
+	if previous, err := readStatsFile(STATS_FILE); err == nil {
+		if err := writeFileAtomic(STATS_BACKUP_FILE, previous); err != nil {
+			log.Println("Error writing stats backup:", err)
+		}
+	}
+
+	// Renaming over a bind mounted file fails, mount its directory instead
+	return writeFileAtomic(STATS_FILE, []byte(value))
+}
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"errors"
 	"log"
+	"slices"
 	"sync"
+	"time"
 
 	"github.com/tidwall/gjson"
 )
@@ -15,34 +18,141 @@ type Team struct {
 	room                     *Room
 	state                    string     // Save state
 	queue                    []string   // Packet queue to apply to Save
+	queueKeys                []string   // compactionKey of each queued packet, empty if it has none
 	droppedFromQueue         int        // Oldest queued packets discarded since the last full state
+	used                     time.Time  // Last time the save or queue was written or requested
 	mu                       sync.Mutex // Mutex for safely updating state/queue
 }
 
-func (t *Team) enqueue(packet string) {
+// Queues a packet for teammates that join later. A packet with a
+// compactionKey replaces the queued packet with the same key, moving it to
+// the back so it still applies after everything queued before it. Returns
+// false if the room has no space left for it.
+func (t *Team) enqueue(packet string) bool {
+	if !t.room.reserve(len(packet), t) {
+		return false
+	}
+
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
+	// Compaction and dropped packets can make the change smaller than reserved
+	before := t.usageLocked()
+	defer func() { t.room.charge(t.usageLocked() - before - len(packet)) }()
+	t.used = time.Now()
+
+	key := gjson.Get(packet, "compactionKey").String()
+	if key != "" {
+		for i, queuedKey := range t.queueKeys {
+			if queuedKey == key {
+				t.queue = append(t.queue[:i], t.queue[i+1:]...)
+				t.queueKeys = append(t.queueKeys[:i], t.queueKeys[i+1:]...)
+				break
+			}
+		}
+	}
+
 	t.queue = append(t.queue, packet)
+	t.queueKeys = append(t.queueKeys, key)
 	if len(t.queue) <= MAX_TEAM_QUEUE {
-		return
+		return true
 	}
 
 	dropped := len(t.queue) - MAX_TEAM_QUEUE
 	copy(t.queue, t.queue[dropped:])
+	copy(t.queueKeys, t.queueKeys[dropped:])
 	for i := MAX_TEAM_QUEUE; i < len(t.queue); i++ {
 		t.queue[i] = ""
 	}
 	t.queue = t.queue[:MAX_TEAM_QUEUE]
+	t.queueKeys = t.queueKeys[:MAX_TEAM_QUEUE]
 
 	if t.droppedFromQueue == 0 {
 		log.Printf("Team %s queue hit %d packets, dropping oldest entries", t.id, MAX_TEAM_QUEUE)
 	}
 	t.droppedFromQueue += dropped
+	return true
+}
+
+// Stores a full save from UPDATE_TEAM_STATE, clearing the queue, and returns
+// the clients that were waiting for it. The save is only stored if the room
+// has space for it.
+func (t *Team) replaceState(state string) ([]uint64, bool) {
+	t.mu.Lock()
+	delta := len(state) - t.usageLocked()
+	t.mu.Unlock()
+	stored := t.room.reserve(delta, t)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	clientIdsRequestingState := t.clientIdsRequestingState
+	t.clientIdsRequestingState = []uint64{}
+	if !stored {
+		return clientIdsRequestingState, false
+	}
+
+	// The save may have changed since delta was reserved
+	before := t.usageLocked()
+	t.state = state
+	t.queue = []string{}
+	t.queueKeys = []string{}
+	t.droppedFromQueue = 0
+	t.used = time.Now()
+	t.room.charge(t.usageLocked() - before - delta)
+
+	return clientIdsRequestingState, true
+}
+
+// Forgets a pending REQUEST_TEAM_STATE from a client that left the team
+func (t *Team) dropStateRequest(clientId uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.clientIdsRequestingState = slices.DeleteFunc(t.clientIdsRequestingState, func(id uint64) bool { return id == clientId })
+}
+
+func (t *Team) lastUsed() time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.used
+}
+
+// Applies a PATCH_TEAM_STATE to the stored save. Replaying the queue after
+// the save would undo a patch applied underneath it, so while anything is
+// queued, or there is no save yet, the patch is queued behind it instead.
+// The server can't apply other queued packets itself, so once one is queued
+// patches only reach the save again after the next full UPDATE_TEAM_STATE.
+func (t *Team) patchState(packet string) error {
+	if _, err := applyPatchPacket("{}", packet); err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	if t.state == "{}" || len(t.queue) > 0 {
+		t.mu.Unlock()
+		if !t.enqueue(packet) {
+			return errors.New("room is out of space on the server")
+		}
+		return nil
+	}
+	defer t.mu.Unlock()
+
+	state, err := applyPatchPacket(t.state, packet)
+	if err != nil {
+		return err
+	}
+	if !t.room.tryCharge(len(state) - len(t.state)) {
+		return errors.New("room is out of space on the server")
+	}
+	t.state = state
+	t.used = time.Now()
+	return nil
 }
 
 func (t *Team) broadcastPacket(packet string) {
 	clientId := gjson.Get(packet, "clientId").Uint()
+	packet = stampServerTime(packet)
 
 	t.room.clients.Range(func(_, value interface{}) bool {
 		client := value.(*Client)
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestPatchStateOrdering(t *testing.T) {
+	const setX = `{"type":"SET_X","addToQueue":true,"x":1}`
+	const patch = `{"type":"PATCH_TEAM_STATE","mergePatch":{"x":2}}`
+
+	tests := []struct {
+		name      string
+		state     string
+		queue     []string
+		packet    string
+		wantState string
+		wantQueue []string
+		wantErr   bool
+	}{
+		{
+			name:      "patch applies to a save with nothing queued",
+			state:     `{"x":0}`,
+			packet:    patch,
+			wantState: `{"x":2}`,
+		},
+		{
+			name:      "patch is queued behind earlier queued packets",
+			state:     `{"x":0}`,
+			queue:     []string{setX},
+			packet:    patch,
+			wantState: `{"x":0}`,
+			wantQueue: []string{setX, patch},
+		},
+		{
+			name:      "patch is queued when there is no save",
+			state:     `{}`,
+			packet:    patch,
+			wantState: `{}`,
+			wantQueue: []string{patch},
+		},
+		{
+			name:      "invalid patch is rejected and changes nothing",
+			state:     `{"x":0}`,
+			queue:     []string{setX},
+			packet:    `{"type":"PATCH_TEAM_STATE","ops":[{"op":"set"}]}`,
+			wantState: `{"x":0}`,
+			wantQueue: []string{setX},
+			wantErr:   true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			team := newTestRoom(t).findOrCreateTeam("team")
+			team.state = test.state
+			for _, packet := range test.queue {
+				team.enqueue(packet)
+			}
+
+			err := team.patchState(test.packet)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("got error %v, want error %t", err, test.wantErr)
+			}
+			if !jsonEqual(team.state, test.wantState) {
+				t.Errorf("got state %s, want %s", team.state, test.wantState)
+			}
+			if fmt.Sprint(team.queue) != fmt.Sprint(append([]string{}, test.wantQueue...)) {
+				t.Errorf("got queue %v, want %v", team.queue, test.wantQueue)
+			}
+		})
+	}
+}
+
+func TestEnqueueCompaction(t *testing.T) {
+	tests := []struct {
+		name    string
+		packets []string
+		want    []string
+	}{
+		{
+			name:    "packets without a key are all kept",
+			packets: []string{`{"f":1}`, `{"f":1}`},
+			want:    []string{`{"f":1}`, `{"f":1}`},
+		},
+		{
+			name:    "a packet replaces the one with the same key and moves to the back",
+			packets: []string{`{"compactionKey":"a","v":1}`, `{"f":1}`, `{"compactionKey":"a","v":2}`},
+			want:    []string{`{"f":1}`, `{"compactionKey":"a","v":2}`},
+		},
+		{
+			name:    "different keys are kept apart",
+			packets: []string{`{"compactionKey":"a"}`, `{"compactionKey":"b"}`},
+			want:    []string{`{"compactionKey":"a"}`, `{"compactionKey":"b"}`},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			room := newTestRoom(t)
+			team := room.findOrCreateTeam("team")
+			before := room.usage.Load()
+			for _, packet := range test.packets {
+				if !team.enqueue(packet) {
+					t.Fatal("enqueue refused a packet")
+				}
+			}
+
+			if fmt.Sprint(team.queue) != fmt.Sprint(test.want) {
+				t.Errorf("got queue %v, want %v", team.queue, test.want)
+			}
+			if used := room.usage.Load() - before; used != int64(team.usage()) {
+				t.Errorf("room charged %d bytes for a queue holding %d", used, team.usage())
+			}
+		})
+	}
+}
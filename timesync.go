@@ -0,0 +1,33 @@
+package main
+
+import (
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+// Clients estimate their clock offset with an NTP style exchange:
+//
+//	-> {"type":"TIME_SYNC","clientSendTime":<client ms>}
+//	<- {"type":"TIME_SYNC","clientSendTime":<client ms>,"serverReceiveTime":<server ms>,"serverSendTime":<server ms>}
+//
+// offset = ((serverReceiveTime - clientSendTime) + (serverSendTime - clientReceiveTime)) / 2
+func (c *Client) replyTimeSync(packet string, received time.Time) {
+	outgoingPacket := `{"type":"TIME_SYNC","quiet":true}`
+	if clientSendTime := gjson.Get(packet, "clientSendTime"); clientSendTime.Exists() {
+		outgoingPacket, _ = sjson.SetRaw(outgoingPacket, "clientSendTime", clientSendTime.Raw)
+	}
+	outgoingPacket, _ = sjson.Set(outgoingPacket, "serverReceiveTime", received.UnixMilli())
+	outgoingPacket, _ = sjson.Set(outgoingPacket, "serverSendTime", time.Now().UnixMilli())
+	c.sendPacket(outgoingPacket)
+}
+
+// Stamps the server's clock in ms onto a packet being relayed
+func stampServerTime(packet string) string {
+	stamped, err := sjson.Set(packet, "serverTime", time.Now().UnixMilli())
+	if err != nil {
+		return packet
+	}
+	return stamped
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/tidwall/gjson"
+	"github.com/tidwall/sjson"
+)
+
+var WEBHOOKS_FILE = dataPath("webhooks.json")
+var WEBHOOKS_PENDING_FILE = dataPath("webhooks.pending.jsonl")
+
+const WEBHOOK_QUEUE_SIZE = 256
+const WEBHOOK_MAX_ATTEMPTS = 5
+const WEBHOOK_INITIAL_BACKOFF = time.Second
+const WEBHOOK_TIMEOUT = 10 * time.Second
+
+const (
+	EVENT_SERVER_START    = "server.start"
+	EVENT_SERVER_STOP     = "server.stop"
+	EVENT_ADMIN_BROADCAST = "admin.broadcast"
+	EVENT_ADMIN_DISABLE   = "admin.disable"
+	EVENT_GAME_COMPLETE   = "game.complete"
+	EVENT_ROOM_CREATE     = "room.create"
+)
+
+// Example webhooks.json, leaving out events subscribes to all of them:
+//
+//	[
+//	  {"url": "http://localhost:8080/anchor", "secret": "hunter2", "events": ["game.complete", "room.create"]}
+//	]
+//
+// Each delivery is a POST of {"event":"...","timestamp":<ms>,"data":{...}}.
+// With a secret set, X-Anchor-Signature carries sha256=<hex HMAC-SHA256 of the body>.
+type Webhook struct {
+	url    string
+	secret string
+	events []string // Empty for every event
+	queue  chan string
+}
+
+type Webhooks struct {
+	hooks       []*Webhook
+	client      *http.Client
+	pending     sync.WaitGroup  // Deliveries not yet sent or given up on
+	ctx         context.Context // Canceled on shutdown to cut deliveries short
+	cancel      context.CancelFunc
+	undelivered []string   // Deliveries cut short, saved to WEBHOOKS_PENDING_FILE
+	mu          sync.Mutex // Mutex for safely updating undelivered
+}
+
+func loadWebhooks(path string) (*Webhooks, error) {
+	w := &Webhooks{client: &http.Client{Timeout: WEBHOOK_TIMEOUT}}
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+
+	value, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return w, nil
+		}
+		return nil, err
+	}
+	if !gjson.ValidBytes(value) {
+		return nil, fmt.Errorf("%s is not valid JSON", path)
+	}
+
+	for i, entry := range gjson.ParseBytes(value).Array() {
+		hook := &Webhook{
+			url:    entry.Get("url").String(),
+			secret: entry.Get("secret").String(),
+			queue:  make(chan string, WEBHOOK_QUEUE_SIZE),
+		}
+		if hook.url == "" {
+			return nil, fmt.Errorf("webhook %d has no url", i)
+		}
+		for _, event := range entry.Get("events").Array() {
+			hook.events = append(hook.events, event.String())
+		}
+
+		w.hooks = append(w.hooks, hook)
+		go w.deliverLoop(hook)
+	}
+
+	if len(w.hooks) > 0 {
+		log.Printf("Loaded %d webhooks\n", len(w.hooks))
+	}
+	w.loadUndelivered()
+	return w, nil
+}
+
+// Queues an event for every webhook subscribed to it. data is a raw JSON object.
+func (w *Webhooks) emit(event string, data string) {
+	if len(w.hooks) == 0 {
+		return
+	}
+
+	payload, _ := sjson.Set(`{}`, "event", event)
+	payload, _ = sjson.Set(payload, "timestamp", time.Now().UnixMilli())
+	payload, _ = sjson.SetRaw(payload, "data", data)
+
+	for _, hook := range w.hooks {
+		if len(hook.events) > 0 && !slices.Contains(hook.events, event) {
+			continue
+		}
+
+		w.enqueue(hook, payload)
+	}
+}
+
+func (w *Webhooks) enqueue(hook *Webhook, payload string) {
+	w.pending.Add(1)
+	select {
+	case hook.queue <- payload:
+	default:
+		w.pending.Done()
+		log.Printf("Webhook queue for %s is full, dropping %s event\n", hook.url, gjson.Get(payload, "event").String())
+	}
+}
+
+// Gives queued deliveries up to timeout to finish, used on shutdown. Whatever
+// is still queued or waiting to be retried after that is saved to
+// WEBHOOKS_PENDING_FILE and sent after the next start.
+func (w *Webhooks) drain(timeout time.Duration) {
+	if len(w.hooks) == 0 {
+		return
+	}
+
+	if !w.wait(timeout) {
+		log.Println("Timed out waiting for webhook deliveries, saving the rest for the next start")
+		w.cancel()
+		w.wait(timeout)
+	}
+	w.saveUndelivered()
+}
+
+func (w *Webhooks) wait(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		w.pending.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (w *Webhooks) keep(hook *Webhook, payload string) {
+	entry, _ := sjson.Set(`{}`, "url", hook.url)
+	entry, _ = sjson.SetRaw(entry, "payload", payload)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.undelivered = append(w.undelivered, entry)
+}
+
+func (w *Webhooks) saveUndelivered() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.undelivered) == 0 {
+		return
+	}
+	value := ""
+	for _, entry := range w.undelivered {
+		value += entry + "\n"
+	}
+	if err := writeFileAtomic(WEBHOOKS_PENDING_FILE, []byte(value)); err != nil {
+		log.Println("Error saving undelivered webhooks:", err)
+		return
+	}
+	log.Printf("Saved %d undelivered webhooks\n", len(w.undelivered))
+}
+
+// Requeues deliveries saved on the last shutdown, for webhooks that still exist
+func (w *Webhooks) loadUndelivered() {
+	value, err := os.ReadFile(WEBHOOKS_PENDING_FILE)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("Error reading undelivered webhooks:", err)
+		}
+		return
+	}
+
+	requeued := 0
+	for _, line := range bytes.Split(value, []byte("\n")) {
+		if !gjson.ValidBytes(line) {
+			continue
+		}
+		entry := gjson.ParseBytes(line)
+		for _, hook := range w.hooks {
+			if hook.url == entry.Get("url").String() {
+				w.enqueue(hook, entry.Get("payload").Raw)
+				requeued++
+				break
+			}
+		}
+	}
+
+	if requeued > 0 {
+		log.Printf("Requeued %d webhooks left undelivered on the last shutdown\n", requeued)
+	}
+	os.Remove(WEBHOOKS_PENDING_FILE)
+}
+
+// Event data for admin actions, mirroring the audit log entry
+func adminEventData(entry AuditEntry, message string) string {
+	data, _ := sjson.Set(`{}`, "action", entry.action)
+	data, _ = sjson.Set(data, "operator", entry.operator.name)
+	data, _ = sjson.Set(data, "source", entry.operator.source)
+	data, _ = sjson.Set(data, "message", message)
+	data, _ = sjson.Set(data, "clientIds", append([]uint64{}, entry.clientIds...))
+	data, _ = sjson.Set(data, "roomIds", append([]string{}, entry.roomIds...))
+	return data
+}
+
+func (w *Webhooks) deliverLoop(hook *Webhook) {
+	for payload := range hook.queue {
+		if w.ctx.Err() != nil {
+			w.keep(hook, payload)
+		} else {
+			w.deliver(hook, payload)
+		}
+		w.pending.Done()
+	}
+}
+
+func (w *Webhooks) deliver(hook *Webhook, payload string) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Panic delivering webhook to %s: %v", hook.url, r)
+		}
+	}()
+
+	event := gjson.Get(payload, "event").String()
+	backoff := WEBHOOK_INITIAL_BACKOFF
+
+	for attempt := 1; attempt <= WEBHOOK_MAX_ATTEMPTS; attempt++ {
+		retry, err := w.post(hook, event, payload)
+		if err == nil {
+			return
+		}
+		if w.ctx.Err() != nil {
+			w.keep(hook, payload)
+			return
+		}
+		if !retry || attempt == WEBHOOK_MAX_ATTEMPTS {
+			log.Printf("Giving up on %s webhook to %s after %d attempts: %v\n", event, hook.url, attempt, err)
+			return
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-w.ctx.Done():
+			w.keep(hook, payload)
+			return
+		}
+		backoff *= 2
+	}
+}
+
+// Returns whether a failed delivery is worth retrying
+func (w *Webhooks) post(hook *Webhook, event string, payload string) (bool, error) {
+	request, err := http.NewRequestWithContext(w.ctx, http.MethodPost, hook.url, bytes.NewBufferString(payload))
+	if err != nil {
+		return false, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("X-Anchor-Event", event)
+	if hook.secret != "" {
+		request.Header.Set("X-Anchor-Signature", "sha256="+signWebhook(hook.secret, []byte(payload)))
+	}
+
+	response, err := w.client.Do(request)
+	if err != nil {
+		return true, err
+	}
+	io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+
+	if response.StatusCode >= 200 && response.StatusCode < 300 {
+		return false, nil
+	}
+	retry := response.StatusCode >= 500 || response.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("status %s", response.Status)
+}
+
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Entry point for `anchor webhook-stub [addr] [secret]`, a receiver that
+// prints every delivery for testing a webhooks.json locally
+func runWebhookStub(args []string) int {
+	addr := "127.0.0.1:8080"
+	if len(args) > 0 {
+		addr = args[0]
+	}
+	secret := ""
+	if len(args) > 1 {
+		secret = args[1]
+	}
+
+	http.HandleFunc("/", func(writer http.ResponseWriter, request *http.Request) {
+		body, err := io.ReadAll(request.Body)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		signature := "unsigned"
+		if header := request.Header.Get("X-Anchor-Signature"); header != "" {
+			signature = "bad signature"
+			if secret != "" && hmac.Equal([]byte(header), []byte("sha256="+signWebhook(secret, body))) {
+				signature = "signature ok"
+			}
+		}
+
+		log.Printf("%s %s (%s): %s\n", request.Method, request.URL.Path, signature, body)
+		writer.WriteHeader(http.StatusNoContent)
+	})
+
+	log.Println("Webhook stub listening on", addr)
+	if err := http.ListenAndServe(addr, nil); err != nil {
+		log.Println(err)
+		return 1
+	}
+	return 0
+}